@@ -0,0 +1,357 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package browse
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/aportelli/golog"
+	"github.com/aportelli/hyperspace/index/db"
+	"github.com/gdamore/tcell/v2"
+	"github.com/mattn/go-runewidth"
+)
+
+type position struct {
+	dir    int64
+	cursor int
+	offset int
+}
+
+// Interactive browser over an index database, only the database is read
+type Browser struct {
+	Db       *db.IndexDb
+	screen   tcell.Screen
+	dir      int64
+	dirPath  string
+	dirUsage *db.UsageEntry
+	entries  []db.UsageEntry
+	cursor   int
+	offset   int
+	history  []position
+	marked   map[int64]bool
+	sortBy   string
+	apparent bool
+}
+
+var (
+	styleDefault  = tcell.StyleDefault
+	styleHeader   = tcell.StyleDefault.Reverse(true)
+	styleSelected = tcell.StyleDefault.Reverse(true).Bold(true)
+	styleBar      = tcell.StyleDefault.Foreground(tcell.ColorBlue)
+	styleMark     = tcell.StyleDefault.Foreground(tcell.ColorRed).Bold(true)
+)
+
+const helpLine = " ↑↓:move  →/enter:open  ←:back  space:mark  s/c/n:sort  a:apparent  q:quit"
+
+func NewBrowser(d *db.IndexDb, start int64, screen tcell.Screen) (*Browser, error) {
+	b := new(Browser)
+	b.Db = d
+	b.screen = screen
+	b.marked = make(map[int64]bool)
+	b.sortBy = "size"
+	err := b.open(start)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// Sorted full paths of the marked entries
+func (b *Browser) MarkedPaths() ([]string, error) {
+	paths := make([]string, 0, len(b.marked))
+	for id := range b.marked {
+		path, err := b.Db.GetFullPath(id)
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Run the browser until the user quits
+func (b *Browser) Run() error {
+	err := b.screen.Init()
+	if err != nil {
+		return err
+	}
+	defer b.screen.Fini()
+	for {
+		b.draw()
+		switch ev := b.screen.PollEvent().(type) {
+		case *tcell.EventResize:
+			b.screen.Sync()
+		case *tcell.EventKey:
+			quit, err := b.handleKey(ev)
+			if err != nil {
+				return err
+			}
+			if quit {
+				return nil
+			}
+		case nil:
+			return nil
+		}
+	}
+}
+
+func (b *Browser) open(id int64) error {
+	var err error
+	b.dirUsage, err = b.Db.GetUsage(id)
+	if err != nil {
+		return err
+	}
+	b.entries, err = b.Db.GetChildrenUsage(id)
+	if err != nil {
+		return err
+	}
+	path, err := b.Db.GetFullPath(id)
+	if err != nil {
+		return err
+	}
+	log.Dbg.Printf("Browser: opening '%s' (%d entries)", path, len(b.entries))
+	b.dir = id
+	b.dirPath = path
+	b.sort()
+	b.cursor = 0
+	b.offset = 0
+	return nil
+}
+
+func (b *Browser) size(e *db.UsageEntry) int64 {
+	if b.apparent {
+		return e.Size
+	}
+	return e.Alloc
+}
+
+func (b *Browser) sort() {
+	var less func(x, y *db.UsageEntry) bool
+	switch b.sortBy {
+	case "count":
+		less = func(x, y *db.UsageEntry) bool { return x.NFiles+x.NDirs > y.NFiles+y.NDirs }
+	case "name":
+		less = func(x, y *db.UsageEntry) bool { return strings.Compare(x.Name, y.Name) < 0 }
+	default:
+		less = func(x, y *db.UsageEntry) bool { return b.size(x) > b.size(y) }
+	}
+	var current int64
+	if b.cursor < len(b.entries) {
+		current = b.entries[b.cursor].Id
+	}
+	sort.SliceStable(b.entries, func(i, j int) bool { return less(&b.entries[i], &b.entries[j]) })
+	for i := range b.entries {
+		if b.entries[i].Id == current {
+			b.cursor = i
+		}
+	}
+}
+
+func (b *Browser) handleKey(ev *tcell.EventKey) (bool, error) {
+	_, height := b.screen.Size()
+	page := height - 3
+	switch ev.Key() {
+	case tcell.KeyUp:
+		b.move(-1)
+	case tcell.KeyDown:
+		b.move(1)
+	case tcell.KeyPgUp:
+		b.move(-page)
+	case tcell.KeyPgDn:
+		b.move(page)
+	case tcell.KeyHome:
+		b.move(-len(b.entries))
+	case tcell.KeyEnd:
+		b.move(len(b.entries))
+	case tcell.KeyRight, tcell.KeyEnter:
+		return false, b.enter()
+	case tcell.KeyLeft, tcell.KeyBackspace, tcell.KeyBackspace2:
+		return false, b.back()
+	case tcell.KeyEscape, tcell.KeyCtrlC:
+		return true, nil
+	case tcell.KeyRune:
+		switch ev.Rune() {
+		case 'q':
+			return true, nil
+		case 'k':
+			b.move(-1)
+		case 'j':
+			b.move(1)
+		case 'l':
+			return false, b.enter()
+		case 'h':
+			return false, b.back()
+		case ' ':
+			if len(b.entries) > 0 {
+				id := b.entries[b.cursor].Id
+				if b.marked[id] {
+					delete(b.marked, id)
+				} else {
+					b.marked[id] = true
+				}
+				b.move(1)
+			}
+		case 's':
+			b.sortBy = "size"
+			b.sort()
+		case 'c':
+			b.sortBy = "count"
+			b.sort()
+		case 'n':
+			b.sortBy = "name"
+			b.sort()
+		case 'a':
+			b.apparent = !b.apparent
+			b.sort()
+		}
+	}
+	return false, nil
+}
+
+func (b *Browser) move(delta int) {
+	b.cursor += delta
+	if b.cursor >= len(b.entries) {
+		b.cursor = len(b.entries) - 1
+	}
+	if b.cursor < 0 {
+		b.cursor = 0
+	}
+}
+
+func (b *Browser) enter() error {
+	if len(b.entries) == 0 || b.entries[b.cursor].Type != "d" {
+		return nil
+	}
+	b.history = append(b.history, position{dir: b.dir, cursor: b.cursor, offset: b.offset})
+	return b.open(b.entries[b.cursor].Id)
+}
+
+func (b *Browser) back() error {
+	if len(b.history) == 0 {
+		dir := b.dir
+		parentId, err := b.Db.GetParentId(dir)
+		if err != nil {
+			// already at the index root
+			return nil
+		}
+		err = b.open(parentId)
+		if err != nil {
+			return err
+		}
+		for i := range b.entries {
+			if b.entries[i].Id == dir {
+				b.cursor = i
+			}
+		}
+		return nil
+	}
+	p := b.history[len(b.history)-1]
+	b.history = b.history[:len(b.history)-1]
+	err := b.open(p.dir)
+	if err != nil {
+		return err
+	}
+	b.cursor = p.cursor
+	b.offset = p.offset
+	b.move(0)
+	return nil
+}
+
+func (b *Browser) drawText(x, y int, style tcell.Style, text string, width int) {
+	for _, r := range text {
+		w := runewidth.RuneWidth(r)
+		if x+w > width {
+			break
+		}
+		b.screen.SetContent(x, y, r, nil, style)
+		x += w
+	}
+	for ; x < width; x++ {
+		b.screen.SetContent(x, y, ' ', nil, style)
+	}
+}
+
+func (b *Browser) draw() {
+	b.screen.Clear()
+	width, height := b.screen.Size()
+	sizeType := "disk usage"
+	if b.apparent {
+		sizeType = "apparent size"
+	}
+	b.drawText(0, 0, styleHeader, fmt.Sprintf(" %s (%s, sorted by %s)", b.dirPath, sizeType, b.sortBy), width)
+
+	// visible window
+	rows := height - 2
+	if b.cursor < b.offset {
+		b.offset = b.cursor
+	}
+	if b.cursor >= b.offset+rows {
+		b.offset = b.cursor - rows + 1
+	}
+	var maxSize int64
+	for i := range b.entries {
+		if s := b.size(&b.entries[i]); s > maxSize {
+			maxSize = s
+		}
+	}
+	const barWidth = 20
+	for i := b.offset; i < len(b.entries) && i < b.offset+rows; i++ {
+		e := &b.entries[i]
+		y := i - b.offset + 1
+		style := styleDefault
+		if i == b.cursor {
+			style = styleSelected
+		}
+		mark := " "
+		if b.marked[e.Id] {
+			mark = "*"
+		}
+		b.drawText(0, y, styleMark, mark, 1)
+		bar := 0
+		if maxSize > 0 {
+			bar = int(barWidth * b.size(e) / maxSize)
+		}
+		name := e.Name
+		if e.Type == "d" {
+			name += "/"
+		} else if e.Type == "l" {
+			name += "@"
+		}
+		text := fmt.Sprintf("%10s %9d [", log.SizeString(log.ByteSize(b.size(e))), e.NFiles+e.NDirs)
+		b.drawText(1, y, style, text, width)
+		x := 1 + len(text)
+		b.drawText(x, y, styleBar, strings.Repeat("#", bar), minInt(x+bar, width))
+		b.drawText(x+bar, y, style, strings.Repeat(" ", barWidth-bar)+"] "+name, width)
+	}
+
+	// status line
+	status := fmt.Sprintf(" Total %s, %d files, %d dirs, %d marked |%s",
+		log.SizeString(log.ByteSize(b.size(b.dirUsage))), b.dirUsage.NFiles, b.dirUsage.NDirs,
+		len(b.marked), helpLine)
+	b.drawText(0, height-1, styleHeader, status, width)
+	b.screen.Show()
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
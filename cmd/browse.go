@@ -0,0 +1,67 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+
+	log "github.com/aportelli/golog"
+	"github.com/aportelli/hyperspace/browse"
+	"github.com/gdamore/tcell/v2"
+	"github.com/spf13/cobra"
+)
+
+// browseCmd represents the browse command
+var browseCmd = &cobra.Command{
+	Use:   "browse [<path>]",
+	Short: "Browse the index interactively",
+	Long: `Browse the index in a full-screen terminal interface, starting from <path>
+(the index root by default). Only the index database is read. The paths of
+the marked entries are printed on exit.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		d := openIndexDb(browseOpt.Db, browseOpt.Index, args)
+		defer d.Close()
+		start := ""
+		if len(args) > 0 {
+			start = args[0]
+		}
+		id := resolvePath(d, start)
+		screen, err := tcell.NewScreen()
+		log.ErrorCheck(err, "could not create terminal screen")
+		b, err := browse.NewBrowser(d, id, screen)
+		log.ErrorCheck(err, "could not open browser")
+		err = b.Run()
+		log.ErrorCheck(err, "browser encountered an error")
+		marked, err := b.MarkedPaths()
+		log.ErrorCheck(err, "could not get marked paths")
+		for _, path := range marked {
+			fmt.Println(path)
+		}
+	},
+}
+
+var browseOpt = struct {
+	Db    string
+	Index string
+}{}
+
+func init() {
+	rootCmd.AddCommand(browseCmd)
+	browseCmd.Flags().StringVarP(&browseOpt.Db, "db", "d", "", "index database path")
+	browseCmd.Flags().StringVarP(&browseOpt.Index, "index", "i", "", "name of the registered index (see 'hs list')")
+}
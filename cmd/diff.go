@@ -0,0 +1,147 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	log "github.com/aportelli/golog"
+	"github.com/aportelli/hyperspace/index/db"
+	"github.com/spf13/cobra"
+)
+
+// diffCmd represents the diff command
+var diffCmd = &cobra.Command{
+	Use:   "diff [<old-db>]",
+	Short: "Compare the index with an older one",
+	Long: `Compare the index with an older index of the same directory. Added (+),
+removed (-), resized (~) and modified (M) entries are listed, or with --dirs
+the directories with the largest size changes. With --snapshot the index is
+compared with one of its own snapshots instead.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		newDb := openIndexDb(diffOpt.Db, diffOpt.Index, nil)
+		defer newDb.Close()
+		var oldPath string
+		if diffOpt.Snapshot > 0 {
+			dir, err := os.MkdirTemp("", "hyperspace")
+			log.ErrorCheck(err, "could not create temporary directory")
+			defer os.RemoveAll(dir)
+			oldPath = filepath.Join(dir, "snapshot.db")
+			err = newDb.ExportSnapshot(diffOpt.Snapshot, oldPath)
+			log.ErrorCheck(err, "could not export snapshot")
+		} else if len(args) > 0 {
+			oldPath = args[0]
+		} else {
+			log.ErrorCheck(errors.New("no index to compare with"), "give an old index or a snapshot")
+		}
+		oldDb := openIndexDb(oldPath, "", nil)
+		defer oldDb.Close()
+		oldRoots := rootPaths(oldDb)
+		newRoots := rootPaths(newDb)
+		if oldRoots != newRoots {
+			log.Warn.Printf("Comparing indexes of different directories '%s' and '%s'", oldRoots, newRoots)
+		}
+		if diffOpt.Dirs {
+			deltas, err := newDb.DiffDirs(oldPath, diffOpt.MaxDepth)
+			log.ErrorCheck(err, "could not compare directories")
+			sort.SliceStable(deltas, func(i, j int) bool { return abs(deltas[i].Delta()) > abs(deltas[j].Delta()) })
+			if diffOpt.Number > 0 && len(deltas) > int(diffOpt.Number) {
+				deltas = deltas[:diffOpt.Number]
+			}
+			for _, dd := range deltas {
+				var path string
+				if dd.Removed {
+					path = fullPath(oldDb, dd.Id)
+				} else {
+					path = fullPath(newDb, dd.Id)
+				}
+				fmt.Printf("%11s  %10s -> %-10s  %s\n", deltaString(dd.Delta()), log.SizeString(log.ByteSize(dd.OldSize)),
+					log.SizeString(log.ByteSize(dd.NewSize)), path)
+			}
+			return
+		}
+		counts := make(map[db.DiffKind]int)
+		deltas := make(map[db.DiffKind]int64)
+		err := newDb.Diff(oldPath, func(e db.DiffEntry) error {
+			counts[e.Kind]++
+			deltas[e.Kind] += e.NewSize - e.OldSize
+			if diffOpt.Summary {
+				return nil
+			}
+			suffix := ""
+			if e.Type == "d" {
+				suffix = "/"
+			}
+			switch e.Kind {
+			case db.DiffAdded:
+				fmt.Printf("+ %11s  %s%s\n", log.SizeString(log.ByteSize(e.NewSize)), fullPath(newDb, e.Id), suffix)
+			case db.DiffRemoved:
+				fmt.Printf("- %11s  %s%s\n", log.SizeString(log.ByteSize(e.OldSize)), fullPath(oldDb, e.Id), suffix)
+			case db.DiffResized:
+				fmt.Printf("~ %11s  %s%s\n", deltaString(e.NewSize-e.OldSize), fullPath(newDb, e.Id), suffix)
+			case db.DiffModified:
+				fmt.Printf("M %11s  %s%s\n", log.SizeString(log.ByteSize(e.NewSize)), fullPath(newDb, e.Id), suffix)
+			}
+			return nil
+		})
+		log.ErrorCheck(err, "could not compare indexes")
+		for _, k := range []db.DiffKind{db.DiffAdded, db.DiffRemoved, db.DiffResized, db.DiffModified} {
+			log.Msg.Printf("%d %s (%s)", counts[k], k.String(), deltaString(deltas[k]))
+		}
+	},
+}
+
+var diffOpt = struct {
+	Db       string
+	Index    string
+	Dirs     bool
+	Summary  bool
+	MaxDepth int
+	Number   uint
+	Snapshot int64
+}{}
+
+func init() {
+	rootCmd.AddCommand(diffCmd)
+	diffCmd.Flags().StringVarP(&diffOpt.Db, "db", "d", "", "index database path")
+	diffCmd.Flags().StringVarP(&diffOpt.Index, "index", "i", "", "name of the registered index (see 'hs list')")
+	diffCmd.Flags().BoolVar(&diffOpt.Dirs, "dirs", false, "list directory size changes")
+	diffCmd.Flags().BoolVarP(&diffOpt.Summary, "summary", "s", false, "only print the number of changes")
+	diffCmd.Flags().IntVarP(&diffOpt.MaxDepth, "max-depth", "m", 1, "maximum directory depth with --dirs (negative: no limit)")
+	diffCmd.Flags().UintVarP(&diffOpt.Number, "number", "n", 20, "number of directories with --dirs (0: all)")
+	diffCmd.Flags().Int64Var(&diffOpt.Snapshot, "snapshot", 0, "compare with this snapshot of the index")
+}
+
+func abs(x int64) int64 {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// Signed size difference string
+func deltaString(delta int64) string {
+	if delta < 0 {
+		return "-" + log.SizeString(log.ByteSize(-delta))
+	}
+	return "+" + log.SizeString(log.ByteSize(delta))
+}
@@ -0,0 +1,116 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	log "github.com/aportelli/golog"
+	"github.com/aportelli/hyperspace/index/db"
+	"github.com/spf13/cobra"
+)
+
+// duCmd represents the du command
+var duCmd = &cobra.Command{
+	Use:   "du [<path>]",
+	Short: "Summarize disk usage from the index",
+	Long: `Summarize the disk usage of the entries below <path> (each index root
+by default), up to the given depth. Sizes are allocated sizes unless
+--apparent-size is used, and files with several hard links are only counted
+once unless --count-links is used.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		d := openIndexDb(duOpt.Db, duOpt.Index, args)
+		defer d.Close()
+		less, err := usageLess(duOpt.Sort, duOpt.ApparentSize, duOpt.CountLinks)
+		log.ErrorCheck(err, "")
+		for _, id := range resolveStarts(d, args) {
+			warnExcluded(d, id)
+			entries, err := d.GetSubtreeUsage(id, duOpt.MaxDepth)
+			log.ErrorCheck(err, "could not get disk usage")
+			total, err := d.GetUsage(id)
+			log.ErrorCheck(err, "could not get disk usage")
+			for i := range entries {
+				entries[i].Name = fullPath(d, entries[i].Id)
+			}
+			sort.SliceStable(entries, func(i, j int) bool {
+				if duOpt.Reverse {
+					return less(entries[j], entries[i])
+				}
+				return less(entries[i], entries[j])
+			})
+			for _, e := range entries {
+				printUsage(usageSize(e, duOpt.ApparentSize, duOpt.CountLinks), e.Name)
+			}
+			printUsage(usageSize(*total, duOpt.ApparentSize, duOpt.CountLinks), fullPath(d, id))
+		}
+	},
+}
+
+var duOpt = struct {
+	Db           string
+	Index        string
+	MaxDepth     uint
+	Sort         string
+	Reverse      bool
+	ApparentSize bool
+	CountLinks   bool
+}{}
+
+func init() {
+	rootCmd.AddCommand(duCmd)
+	duCmd.Flags().StringVarP(&duOpt.Db, "db", "d", "", "index database path")
+	duCmd.Flags().StringVarP(&duOpt.Index, "index", "i", "", "name of the registered index (see 'hs list')")
+	duCmd.Flags().UintVarP(&duOpt.MaxDepth, "max-depth", "m", 1, "maximum depth of the listed entries")
+	duCmd.Flags().StringVarP(&duOpt.Sort, "sort", "s", "size", "sort order ('size', 'count' or 'name')")
+	duCmd.Flags().BoolVarP(&duOpt.Reverse, "reverse", "r", false, "reverse sort order")
+	duCmd.Flags().BoolVarP(&duOpt.ApparentSize, "apparent-size", "A", false, "use apparent sizes instead of allocated sizes")
+	duCmd.Flags().BoolVarP(&duOpt.CountLinks, "count-links", "l", false, "count sizes of hard linked files once per name")
+}
+
+func usageSize(e db.UsageEntry, apparent bool, links bool) int64 {
+	switch {
+	case apparent && links:
+		return e.LinkSize
+	case apparent:
+		return e.Size
+	case links:
+		return e.LinkAlloc
+	default:
+		return e.Alloc
+	}
+}
+
+// Ordering function for usage entries, largest first
+func usageLess(order string, apparent bool, links bool) (func(a, b db.UsageEntry) bool, error) {
+	switch order {
+	case "size":
+		return func(a, b db.UsageEntry) bool { return usageSize(a, apparent, links) > usageSize(b, apparent, links) }, nil
+	case "count":
+		return func(a, b db.UsageEntry) bool { return a.NFiles+a.NDirs > b.NFiles+b.NDirs }, nil
+	case "name":
+		return func(a, b db.UsageEntry) bool { return strings.Compare(a.Name, b.Name) < 0 }, nil
+	default:
+		return nil, fmt.Errorf("invalid sort order '%s'", order)
+	}
+}
+
+func printUsage(size int64, path string) {
+	fmt.Printf("%10s  %s\n", log.SizeString(log.ByteSize(size)), path)
+}
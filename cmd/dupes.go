@@ -0,0 +1,160 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"runtime"
+	"strings"
+	"time"
+
+	log "github.com/aportelli/golog"
+	"github.com/aportelli/hyperspace/index"
+	"github.com/aportelli/hyperspace/index/db"
+	"github.com/aportelli/hyperspace/index/hash"
+	"github.com/briandowns/spinner"
+	"github.com/spf13/cobra"
+)
+
+// dupesCmd represents the dupes command
+var dupesCmd = &cobra.Command{
+	Use:   "dupes",
+	Short: "Find duplicate files in the index",
+	Long: `Find duplicate files in the index. Candidates are files of equal size,
+only files which cannot be told apart by their first and last blocks are
+read entirely. Content checksums are stored in the index and reused by later
+searches. With --dirs, directories with identical subtrees are reported
+instead. Files without a content checksum (see 'hs index --checksum') are only
+compared by name and size, and a warning is printed.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var sets []db.DuplicateSet
+		d := openIndexDb(dupesOpt.Db, dupesOpt.Index, nil)
+		defer d.Close()
+		if dupesOpt.Dirs {
+			spin := spinner.New(spinString, 100*time.Millisecond)
+			spin.Color("blue")
+			spin.Suffix = " Computing directory Merkle hashes"
+			spin.Start()
+			missing, err := d.ComputeMerkleHashes()
+			spin.Stop()
+			log.ErrorCheck(err, "could not compute directory hashes")
+			if missing > 0 {
+				log.Warn.Printf("%d file(s) have no content checksum and are compared by name and size only, "+
+					"run 'hs index --checksum' to compare their content", missing)
+			}
+			sets, err = d.GetDuplicateDirs()
+			log.ErrorCheck(err, "could not get duplicate directories")
+			printDuplicates(d, sets)
+			return
+		}
+		d.BatchSize = 10000
+		opt := index.DupesOpt{Algorithm: dupesOpt.Algorithm, MinSize: 1}
+		if dupesOpt.MinSize != "" {
+			var err error
+			opt.MinSize, err = parseSize(dupesOpt.MinSize)
+			log.ErrorCheck(err, "")
+		}
+		if opt.Algorithm == "" {
+			opt.Algorithm = "sha256"
+			value, err := d.GetValue("checksum_algo")
+			if algo, ok := value.(string); err == nil && ok {
+				opt.Algorithm = algo
+			}
+		}
+		fileIndexer := index.NewFileIndexer(d, dupesOpt.NumWorkers)
+		spin := spinner.New(spinString, 100*time.Millisecond)
+		spin.Color("blue")
+		done := make(chan int)
+		sigint := make(chan os.Signal, 1)
+		signal.Notify(sigint, os.Interrupt)
+		go func() {
+			<-sigint
+			if spin.Active() {
+				spin.Stop()
+			}
+			log.Warn.Println("Search interrupted")
+			fileIndexer.Interrupt()
+		}()
+		go func() {
+			var err error
+			sets, err = fileIndexer.FindDuplicates(opt)
+			var e *index.InterruptError
+			if errors.As(err, &e) {
+				done <- 1
+			} else {
+				log.ErrorCheck(err, "duplicate search encountered an error")
+			}
+			done <- 0
+		}()
+		ticker := time.NewTicker(500 * time.Millisecond)
+		status := -1
+		for status < 0 {
+			select {
+			case status = <-done:
+			case <-ticker.C:
+				if !spin.Active() {
+					spin.Start()
+				}
+				stats := fileIndexer.Stats()
+				spin.Suffix = fmt.Sprintf(" %d workers | read %d files, %s", stats.ActiveWorkers,
+					stats.NFiles, log.SizeString(log.ByteSize(stats.TotalSize)))
+			}
+		}
+		spin.Stop()
+		printDuplicates(d, sets)
+		if status > 0 {
+			quit(status)
+		}
+	},
+}
+
+func printDuplicates(d *db.IndexDb, sets []db.DuplicateSet) {
+	var total int64
+	for _, set := range sets {
+		total += set.Reclaimable()
+		fmt.Printf("%s x %d, %s reclaimable\n", log.SizeString(log.ByteSize(set.Size)), len(set.Ids),
+			log.SizeString(log.ByteSize(set.Reclaimable())))
+		for _, id := range set.Ids {
+			fmt.Printf("  %s\n", fullPath(d, id))
+		}
+	}
+	log.Msg.Printf("Found %d duplicate set(s), %s reclaimable", len(sets), log.SizeString(log.ByteSize(total)))
+}
+
+var dupesOpt = struct {
+	Db         string
+	Index      string
+	Dirs       bool
+	Algorithm  string
+	MinSize    string
+	NumWorkers uint
+}{}
+
+func init() {
+	rootCmd.AddCommand(dupesCmd)
+	dupesCmd.Flags().StringVarP(&dupesOpt.Db, "db", "d", "", "index database path")
+	dupesCmd.Flags().StringVarP(&dupesOpt.Index, "index", "i", "", "name of the registered index (see 'hs list')")
+	dupesCmd.Flags().BoolVar(&dupesOpt.Dirs, "dirs", false, "find duplicate directory subtrees instead of files")
+	dupesCmd.Flags().StringVar(&dupesOpt.Algorithm, "algo", "",
+		"checksum algorithm ("+strings.Join(hash.ContentAlgorithms, ", ")+"), default: the index one or sha256")
+	dupesCmd.Flags().StringVar(&dupesOpt.MinSize, "min-size", "", "minimum file size (default 1 byte)")
+	dupesCmd.Flags().UintVarP(&dupesOpt.NumWorkers, "jobs", "j", (uint)(runtime.NumCPU()), "number of concurrent reader tasks")
+}
@@ -0,0 +1,72 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"syscall"
+
+	log "github.com/aportelli/golog"
+	"github.com/aportelli/hyperspace/index/db"
+	"github.com/spf13/cobra"
+)
+
+// errorsCmd represents the errors command
+var errorsCmd = &cobra.Command{
+	Use:   "errors",
+	Short: "List the errors of the last indexing run",
+	Long: `List the entries which could not be read during the last indexing run,
+with the failing operation and the error message. The subtrees of unreadable
+directories are missing from the index.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		d := openIndexDb(errorsOpt.Db, errorsOpt.Index, nil)
+		defer d.Close()
+		n := 0
+		err := d.GetScanErrors(func(e db.ScanError) error {
+			n++
+			if errorsOpt.Summary {
+				return nil
+			}
+			path := e.Root
+			if e.Path != "" {
+				path += "/" + e.Path
+			}
+			msg := e.Message
+			if e.Errno != 0 {
+				msg = syscall.Errno(e.Errno).Error()
+			}
+			fmt.Printf("%-8s %s: %s\n", e.Operation, path, msg)
+			return nil
+		})
+		log.ErrorCheck(err, "could not get scan errors")
+		log.Msg.Printf("%d scan error(s)", n)
+	},
+}
+
+var errorsOpt = struct {
+	Db      string
+	Index   string
+	Summary bool
+}{}
+
+func init() {
+	rootCmd.AddCommand(errorsCmd)
+	errorsCmd.Flags().StringVarP(&errorsOpt.Db, "db", "d", "", "index database path")
+	errorsCmd.Flags().StringVarP(&errorsOpt.Index, "index", "i", "", "name of the registered index (see 'hs list')")
+	errorsCmd.Flags().BoolVarP(&errorsOpt.Summary, "summary", "s", false, "only print the number of errors")
+}
@@ -0,0 +1,108 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"regexp"
+
+	log "github.com/aportelli/golog"
+	"github.com/aportelli/hyperspace/index/db"
+	"github.com/spf13/cobra"
+)
+
+// findCmd represents the find command
+var findCmd = &cobra.Command{
+	Use:   "find [<path>]",
+	Short: "Search the index",
+	Long: `Search the index for entries matching the given criteria. If <path> is
+given, only its subtree is searched, depths are relative to <path>. Otherwise
+all the roots of the index are searched, depths are relative to each root.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		d := openIndexDb(findOpt.Db, findOpt.Index, args)
+		defer d.Close()
+		opt := db.NewFindOpt(0)
+		opt.Glob = findOpt.Name
+		if findOpt.Regex != "" {
+			opt.Regex, err = regexp.Compile(findOpt.Regex)
+			log.ErrorCheck(err, "invalid regular expression")
+		}
+		switch findOpt.Type {
+		case "", "d", "f", "l", "p", "s", "b", "c":
+			opt.Type = findOpt.Type
+		default:
+			log.ErrorCheck(fmt.Errorf("invalid type '%s'", findOpt.Type), "type must be one of d, f, l, p, s, b, c")
+		}
+		opt.Dangling = findOpt.Dangling
+		if findOpt.MinSize != "" {
+			opt.MinSize, err = parseSize(findOpt.MinSize)
+			log.ErrorCheck(err, "")
+		}
+		if findOpt.MaxSize != "" {
+			opt.MaxSize, err = parseSize(findOpt.MaxSize)
+			log.ErrorCheck(err, "")
+		}
+		opt.MinDepth = findOpt.MinDepth
+		opt.MaxDepth = findOpt.MaxDepth
+		for _, start := range resolveStarts(d, args) {
+			opt.Start = start
+			err = d.Find(opt, func(id int64, name string) error {
+				if opt.Type == "l" || opt.Dangling {
+					e, err := d.GetEntry(id)
+					if err != nil {
+						return err
+					}
+					fmt.Printf("%s -> %s\n", fullPath(d, id), e.Target)
+				} else {
+					fmt.Println(fullPath(d, id))
+				}
+				return nil
+			})
+			log.ErrorCheck(err, "search failed")
+		}
+	},
+}
+
+var findOpt = struct {
+	Db       string
+	Index    string
+	Name     string
+	Regex    string
+	Type     string
+	MinSize  string
+	MaxSize  string
+	MinDepth int
+	MaxDepth int
+	Dangling bool
+}{}
+
+func init() {
+	rootCmd.AddCommand(findCmd)
+	findCmd.Flags().StringVarP(&findOpt.Db, "db", "d", "", "index database path")
+	findCmd.Flags().StringVarP(&findOpt.Index, "index", "i", "", "name of the registered index (see 'hs list')")
+	findCmd.Flags().StringVarP(&findOpt.Name, "name", "n", "", "name glob pattern")
+	findCmd.Flags().StringVarP(&findOpt.Regex, "regex", "r", "", "name regular expression")
+	findCmd.Flags().StringVarP(&findOpt.Type, "type", "t", "",
+		"entry type ('d': directory, 'f': file, 'l': symlink, 'p': pipe, 's': socket, 'b'/'c': block/char device)")
+	findCmd.Flags().StringVar(&findOpt.MinSize, "min-size", "", "minimum size (e.g. 10M)")
+	findCmd.Flags().StringVar(&findOpt.MaxSize, "max-size", "", "maximum size (e.g. 2G)")
+	findCmd.Flags().IntVar(&findOpt.MinDepth, "min-depth", -1, "minimum depth")
+	findCmd.Flags().IntVar(&findOpt.MaxDepth, "max-depth", -1, "maximum depth")
+	findCmd.Flags().BoolVar(&findOpt.Dangling, "dangling", false, "only list symbolic links with a missing target")
+}
@@ -16,6 +16,18 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 */
 package cmd
 
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+
+	log "github.com/aportelli/golog"
+	"github.com/aportelli/hyperspace/index/db"
+)
+
 var spinString []string = []string{
 	"(*---------)",
 	"(-*--------)",
@@ -35,3 +47,176 @@ var spinString []string = []string{
 	"(---*------)",
 	"(--*-------)",
 	"(-*--------)"}
+
+// Name of the index used when none is given
+const defaultIndexName = "index"
+
+var indexNameRegexp = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// Directory of the index registry in the user cache directory, the index
+// named <name> being the database <name>.db
+func registryDir() string {
+	cacheDir, err := os.UserCacheDir()
+	log.ErrorCheck(err, "")
+	dir := filepath.Join(cacheDir, "hyperspace")
+	err = os.MkdirAll(dir, 0750)
+	log.ErrorCheck(err, "")
+	return dir
+}
+
+// Database path of a registered index
+func indexPath(name string) string {
+	if !indexNameRegexp.MatchString(name) {
+		log.ErrorCheck(fmt.Errorf("invalid index name '%s'", name),
+			"names are made of letters, digits, '.', '_' and '-'")
+	}
+	return filepath.Join(registryDir(), name+".db")
+}
+
+// Sorted names of the registered indexes
+func indexNames() []string {
+	paths, err := filepath.Glob(filepath.Join(registryDir(), "*.db"))
+	log.ErrorCheck(err, "")
+	names := make([]string, 0, len(paths))
+	for _, p := range paths {
+		names = append(names, strings.TrimSuffix(filepath.Base(p), ".db"))
+	}
+	return names
+}
+
+// Database path of the registered index with the innermost root containing the
+// absolute path, empty if there is none
+func findIndex(path string) string {
+	found, foundRoot := "", ""
+	for _, name := range indexNames() {
+		dbPath := indexPath(name)
+		d, err := db.OpenReadOnly(dbPath)
+		if err != nil {
+			log.Dbg.Printf("could not open index '%s': %s", name, err.Error())
+			continue
+		}
+		root, _, err := d.FindRoot(path)
+		d.Close()
+		if err == nil && len(root.Path) > len(foundRoot) {
+			found, foundRoot = dbPath, root.Path
+		}
+	}
+	return found
+}
+
+// Open an existing index database for querying, given by its path or by its
+// name in the registry. Otherwise the registered index containing the queried
+// path (the first of args if any) is used, and the default index (or the only
+// registered one) if there is none. A relative path is looked up from the
+// working directory, and replaced by its absolute path in args if an index
+// contains it.
+func openIndexDb(dbPath string, name string, args []string) *db.IndexDb {
+	if dbPath == "" && name != "" {
+		dbPath = indexPath(name)
+	}
+	if dbPath == "" && len(args) > 0 {
+		absPath, err := filepath.Abs(args[0])
+		log.ErrorCheck(err, "")
+		dbPath = findIndex(absPath)
+		if dbPath != "" {
+			args[0] = absPath
+		}
+	}
+	if dbPath == "" {
+		dbPath = indexPath(defaultIndexName)
+		names := indexNames()
+		if len(names) == 1 {
+			dbPath = indexPath(names[0])
+		} else if _, err := os.Stat(dbPath); err != nil && len(names) > 1 {
+			log.ErrorCheck(fmt.Errorf("%d indexes registered", len(names)), "choose one with --index")
+		}
+	}
+	log.Dbg.Println("using database '" + dbPath + "'")
+	_, err := os.Stat(dbPath)
+	log.ErrorCheck(err, "could not find index database, run 'hs index' first")
+	d, err := db.NewIndexDb(dbPath, db.IndexDbOpt{Reset: false, BatchSize: 0})
+	log.ErrorCheck(err, "could not open database")
+	return d
+}
+
+// Resolve a path argument to an id in the index, the empty path being the root
+func resolvePath(d *db.IndexDb, path string) int64 {
+	id, err := d.GetId(path)
+	log.ErrorCheck(err, "could not find '"+path+"' in the index")
+	return id
+}
+
+// Resolve the optional path argument of a query to the entries it starts from,
+// the top directories of all the index roots if there is no argument
+func resolveStarts(d *db.IndexDb, args []string) []int64 {
+	if len(args) > 0 {
+		return []int64{resolvePath(d, args[0])}
+	}
+	roots, err := d.GetRoots()
+	log.ErrorCheck(err, "could not get index roots")
+	ids := make([]int64, 0, len(roots))
+	for _, r := range roots {
+		id, err := d.GetRootEntryId(r.Id)
+		log.ErrorCheck(err, "could not find root '"+r.Path+"' in the index")
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// Comma-separated paths of the roots of an index
+func rootPaths(d *db.IndexDb) string {
+	roots, err := d.GetRoots()
+	log.ErrorCheck(err, "could not get index roots")
+	paths := make([]string, 0, len(roots))
+	for _, r := range roots {
+		paths = append(paths, r.Path)
+	}
+	return strings.Join(paths, ", ")
+}
+
+// Full path of an entry in the index
+func fullPath(d *db.IndexDb, id int64) string {
+	path, err := d.GetFullPath(id)
+	log.ErrorCheck(err, "could not get path")
+	return path
+}
+
+// Warn if the subtree with root id is only partially indexed
+func warnExcluded(d *db.IndexDb, id int64) {
+	path, err := d.GetPath(id)
+	log.ErrorCheck(err, "could not get path")
+	root, err := d.GetEntryRoot(id)
+	log.ErrorCheck(err, "could not get index root")
+	n := 0
+	for _, e := range root.Excluded {
+		if path == "" || e == path || strings.HasPrefix(e, path+"/") {
+			n++
+		}
+	}
+	if n > 0 {
+		log.Warn.Printf("%d excluded subtree(s) not included in the index", n)
+	}
+	if root.MaxDepth >= 0 {
+		log.Warn.Printf("Index of '%s' limited to depth %d", root.Path, root.MaxDepth)
+	}
+}
+
+// Parse sizes like 10, 512k, 2.5G (binary units, like log.SizeString)
+func parseSize(s string) (int64, error) {
+	units := map[byte]log.ByteSize{
+		'k': log.KB, 'K': log.KB, 'M': log.MB, 'G': log.GB, 'T': log.TB, 'P': log.PB, 'E': log.EB,
+	}
+	str := strings.TrimSuffix(strings.TrimSuffix(s, "B"), "i")
+	mult := log.ByteSize(1)
+	if len(str) > 0 {
+		if u, ok := units[str[len(str)-1]]; ok {
+			mult = u
+			str = str[:len(str)-1]
+		}
+	}
+	v, err := strconv.ParseFloat(str, 64)
+	if err != nil || v < 0 {
+		return -1, fmt.Errorf("invalid size '%s'", s)
+	}
+	return int64(log.ByteSize(v) * mult), nil
+}
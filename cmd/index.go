@@ -22,11 +22,13 @@ import (
 	"os"
 	"os/signal"
 	"runtime"
+	"strings"
 	"time"
 
 	log "github.com/aportelli/golog"
 	"github.com/aportelli/hyperspace/index"
 	"github.com/aportelli/hyperspace/index/db"
+	"github.com/aportelli/hyperspace/index/hash"
 	"github.com/briandowns/spinner"
 	"github.com/spf13/cobra"
 )
@@ -35,28 +37,38 @@ import (
 var indexCmd = &cobra.Command{
 	Use:   "index <dir>",
 	Short: "Index directory",
-	Long:  ``,
-	Args:  cobra.ExactArgs(1),
+	Long: `Index the directory <dir>. The index is rebuilt with <dir> as its only root,
+unless --update is used: the entries of <dir> are then updated, or added as a
+new root, and the other roots of the index are left untouched. Indexes are
+registered by name in the user cache directory, query commands use the index
+whose root contains their path argument. Rebuilding an index discards its
+snapshots, use --update to keep its history.`,
+	Args: cobra.ExactArgs(1),
 	Run: func(cmd *cobra.Command, args []string) {
 		var status int
 		root := args[0]
 		dbPath := indexOpt.Db
 		if dbPath == "" {
-			cacheDir, err := os.UserCacheDir()
-			log.ErrorCheck(err, "")
-			err = os.MkdirAll(cacheDir+"/hyperspace", 0750)
-			dbPath = cacheDir + "/hyperspace/index.db"
-			log.ErrorCheck(err, "")
+			dbPath = indexPath(indexOpt.Name)
 		}
 		log.Dbg.Println("using database '" + dbPath + "'")
+		indexOpt.DbOpt.Swap = !indexOpt.DbOpt.Update
+		if indexOpt.DbOpt.Swap {
+			warnDiscardedSnapshots(dbPath)
+		}
 		db, err := db.NewIndexDb(dbPath, indexOpt.DbOpt)
 		log.ErrorCheck(err, "could not create database")
 		fileIndexer := index.NewFileIndexer(db, indexOpt.NumWorkers)
+		fileIndexer.ScanOpt = indexOpt.ScanOpt
+		fileIndexer.Resume = indexOpt.DbOpt.Resume
+		if indexOpt.GitIgnore {
+			fileIndexer.ScanOpt.IgnoreFiles = append(fileIndexer.ScanOpt.IgnoreFiles, ".gitignore")
+		}
 		spin := spinner.New(spinString, 100*time.Millisecond)
 		spin.Color("blue")
 		log.Msg.Printf("Scanning directory '%s'", root)
 		done := make(chan int)
-		sigint := make(chan os.Signal)
+		sigint := make(chan os.Signal, 1)
 		signal.Notify(sigint, os.Interrupt)
 		tickerDt := 500 * time.Millisecond
 		ticker := time.NewTicker(tickerDt)
@@ -68,6 +80,7 @@ var indexCmd = &cobra.Command{
 			log.Warn.Println("Indexing interrupted")
 			fileIndexer.Interrupt()
 		}()
+		tScan := time.Now()
 		go func() {
 			err := fileIndexer.IndexDir(root)
 			var e *index.InterruptError
@@ -95,7 +108,7 @@ var indexCmd = &cobra.Command{
 				stats := fileIndexer.Stats()
 				dbInserts := fileIndexer.Db.Insertions
 				spin.Suffix = fmt.Sprintf(" %.0f file/s | %d workers | %d queued | %.0f DB insert/s | total %d files, %s",
-					float64(stats.NFiles-nfilesPrevious)/dt.Seconds(), stats.ActiveWorkers, stats.QueuingWorkers,
+					float64(stats.NFiles-nfilesPrevious)/dt.Seconds(), stats.ActiveWorkers, stats.QueuedDirs,
 					float64(dbInserts-ninsertPrevious)/dt.Seconds(), stats.NFiles, log.SizeString(log.ByteSize(stats.TotalSize)))
 				tPrevious = t
 				nfilesPrevious = stats.NFiles
@@ -103,10 +116,89 @@ var indexCmd = &cobra.Command{
 			}
 		}
 		spin.Stop()
+		scanDuration := time.Since(tScan)
 		printTotalStats(tStart, fileIndexer)
+		if fileIndexer.Db.Update {
+			log.Msg.Printf("Index updated: %d new, %d modified, %d deleted entries",
+				fileIndexer.Db.Insertions, fileIndexer.Db.Updates, fileIndexer.Db.Deletions)
+		}
+		if fileIndexer.Db.Collisions > 0 {
+			log.Warn.Printf("%d path hash collision(s) resolved with alternative ids", fileIndexer.Db.Collisions)
+		}
 		if status > 0 {
+			interruptIndex(db)
 			quit(status)
 		}
+		if indexOpt.Checksum {
+			opt := index.ChecksumOpt{Algorithm: indexOpt.ChecksumAlgo, MaxSize: -1, Rate: 0}
+			if indexOpt.ChecksumMaxSize != "" {
+				opt.MaxSize, err = parseSize(indexOpt.ChecksumMaxSize)
+				log.ErrorCheck(err, "")
+			}
+			if indexOpt.ChecksumRate != "" {
+				rate, err := parseSize(indexOpt.ChecksumRate)
+				log.ErrorCheck(err, "")
+				opt.Rate = float64(rate)
+			}
+			log.Msg.Printf("Computing %s file checksums", opt.Algorithm)
+			go func() {
+				err := fileIndexer.ChecksumFiles(opt)
+				var e *index.InterruptError
+				if errors.As(err, &e) {
+					done <- 1
+				} else {
+					log.ErrorCheck(err, "checksum computation encountered an error")
+				}
+				done <- 0
+			}()
+			tStart = time.Now()
+			tPrevious = tStart
+			var sizePrevious uint64
+		out2:
+			for {
+				select {
+				case status = <-done:
+					break out2
+				case t := <-ticker.C:
+					if !spin.Active() {
+						spin.Start()
+					}
+					dt := t.Sub(tPrevious)
+					stats := fileIndexer.Stats()
+					spin.Suffix = fmt.Sprintf(" %s/s | %d workers | total %d files, %s",
+						log.SizeString(log.ByteSize(float64(stats.TotalSize-sizePrevious)/dt.Seconds())),
+						stats.ActiveWorkers, stats.NFiles, log.SizeString(log.ByteSize(stats.TotalSize)))
+					tPrevious = t
+					sizePrevious = stats.TotalSize
+				}
+			}
+			spin.Stop()
+			dt := time.Since(tStart)
+			stats := fileIndexer.Stats()
+			log.Msg.Printf("Checksummed %d file(s), total size %s, %s/s, it took %s", stats.NFiles,
+				log.SizeString(log.ByteSize(stats.TotalSize)),
+				log.SizeString(log.ByteSize(float64(stats.TotalSize)/dt.Seconds())), dt.String())
+			if stats.NErrors > 0 {
+				log.Warn.Printf("%d file(s) could not be checksummed", stats.NErrors)
+			}
+			if status > 0 {
+				interruptIndex(db)
+				quit(status)
+			}
+		}
+		tStart = time.Now()
+		go func() {
+			err := fileIndexer.Db.ComputeRollups()
+			log.ErrorCheck(err, "could not compute directory rollups")
+			done <- 0
+		}()
+		spin.Start()
+		spin.Suffix = " Computing directory rollups"
+		<-done
+		spin.Stop()
+		log.Msg.Println("Directory rollups computed, it took", time.Since(tStart).String())
+		err = fileIndexer.Db.RecordScan(tScan.Add(scanDuration), scanDuration)
+		log.ErrorCheck(err, "could not record scan summary")
 		tStart = time.Now()
 		go func() {
 			err := fileIndexer.Db.CreateIndices()
@@ -124,9 +216,16 @@ var indexCmd = &cobra.Command{
 }
 
 var indexOpt = struct {
-	Db         string
-	DbOpt      db.IndexDbOpt
-	NumWorkers uint
+	Db              string
+	Name            string
+	DbOpt           db.IndexDbOpt
+	NumWorkers      uint
+	Checksum        bool
+	ChecksumAlgo    string
+	ChecksumMaxSize string
+	ChecksumRate    string
+	ScanOpt         index.ScanOpt
+	GitIgnore       bool
 }{
 	Db:         "",
 	DbOpt:      db.IndexDbOpt{Reset: true, BatchSize: 0},
@@ -136,8 +235,26 @@ var indexOpt = struct {
 func init() {
 	rootCmd.AddCommand(indexCmd)
 	indexCmd.Flags().StringVarP(&indexOpt.Db, "db", "d", "", "index database path")
+	indexCmd.Flags().StringVarP(&indexOpt.Name, "name", "n", defaultIndexName, "name of the index in the registry (see 'hs list')")
 	indexCmd.Flags().UintVarP(&indexOpt.NumWorkers, "jobs", "j", (uint)(runtime.NumCPU()), "number of concurrent scanner tasks")
+	indexCmd.Flags().BoolVarP(&indexOpt.DbOpt.Update, "update", "u", false, "add a snapshot to the existing index instead of rebuilding it, adding <dir> to its roots if needed")
+	indexCmd.Flags().BoolVar(&indexOpt.DbOpt.Resume, "resume", false, "continue an interrupted scan")
 	indexCmd.Flags().UintVarP(&indexOpt.DbOpt.BatchSize, "db-batch", "b", 10000, "number of insertion per DB transaction")
+	indexCmd.Flags().StringVar(&indexOpt.DbOpt.Hasher, "hash", "",
+		"path id scheme of a new index ("+strings.Join(hash.HasherNames(), ", ")+", default "+hash.DefaultHasher+")")
+	indexCmd.Flags().BoolVar(&indexOpt.Checksum, "checksum", false, "compute file content checksums")
+	indexCmd.Flags().StringVar(&indexOpt.ChecksumAlgo, "checksum-algo", "sha256",
+		"checksum algorithm ("+strings.Join(hash.ContentAlgorithms, ", ")+")")
+	indexCmd.Flags().StringVar(&indexOpt.ChecksumMaxSize, "checksum-max-size", "", "do not checksum files larger than this size (e.g. 1G)")
+	indexCmd.Flags().StringVar(&indexOpt.ChecksumRate, "checksum-rate", "", "maximum checksum read throughput per second (e.g. 100M)")
+	indexCmd.Flags().StringArrayVar(&indexOpt.ScanOpt.Exclude, "exclude", nil, "exclude entries matching this gitignore-style pattern")
+	indexCmd.Flags().StringArrayVar(&indexOpt.ScanOpt.Include, "include", nil, "include entries matching this pattern even if excluded")
+	indexCmd.Flags().StringArrayVar(&indexOpt.ScanOpt.IgnoreFiles, "ignore-file", []string{".hsignore"}, "name of per-directory ignore files")
+	indexCmd.Flags().BoolVar(&indexOpt.GitIgnore, "gitignore", false, "also honour .gitignore files")
+	indexCmd.Flags().BoolVarP(&indexOpt.ScanOpt.OneFileSystem, "one-file-system", "x", false, "do not scan directories on other file systems")
+	indexCmd.Flags().IntVar(&indexOpt.ScanOpt.MaxDepth, "max-depth", -1, "maximum scanning depth (negative: no limit)")
+	indexCmd.Flags().BoolVarP(&indexOpt.ScanOpt.FollowSymlinks, "follow-symlinks", "L", false, "index symbolic links as their target")
+	indexCmd.Flags().BoolVar(&indexOpt.ScanOpt.DepthFirst, "depth-first", false, "scan directories in depth-first order")
 }
 
 func printTotalStats(tStart time.Time, fileIndexer *index.FileIndexer) {
@@ -146,4 +263,37 @@ func printTotalStats(tStart time.Time, fileIndexer *index.FileIndexer) {
 	log.Msg.Printf("Indexed %d file(s), total size %s, %.0f files/s", stats.NFiles,
 		log.SizeString(log.ByteSize(stats.TotalSize)), float64(stats.NFiles)/dt.Seconds())
 	log.Msg.Println("Total indexing time", dt.String())
+	if stats.NErrors > 0 {
+		log.Warn.Printf("%d entries could not be read, run 'hs errors' to list them", stats.NErrors)
+	}
+}
+
+// Close an interrupted index, the previous index is kept until a rebuilt one is
+// complete
+func interruptIndex(d *db.IndexDb) {
+	resumable, err := d.HasCheckpoint()
+	log.ErrorCheck(err, "could not read database")
+	err = d.Close()
+	log.ErrorCheck(err, "could not close database")
+	if !indexOpt.DbOpt.Update {
+		log.Warn.Println("Index not rebuilt, the previous index is unchanged")
+	}
+	if resumable {
+		log.Warn.Println("Run the same command with --resume to continue the scan")
+	}
+}
+
+// Warn that rebuilding the index at dbPath discards the snapshots it holds
+func warnDiscardedSnapshots(dbPath string) {
+	d, err := db.OpenReadOnly(dbPath)
+	if err != nil {
+		return
+	}
+	defer d.Close()
+	snapshots, err := d.GetSnapshots()
+	if err != nil || len(snapshots) == 0 {
+		return
+	}
+	log.Warn.Printf("Rebuilding index '%s' discards its %d snapshot(s), use --update to keep its history",
+		dbPath, len(snapshots))
 }
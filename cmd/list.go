@@ -0,0 +1,73 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"time"
+
+	log "github.com/aportelli/golog"
+	"github.com/aportelli/hyperspace/index/db"
+	"github.com/spf13/cobra"
+)
+
+// listCmd represents the list command
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List the registered indexes",
+	Long: `List the indexes registered in the user cache directory with their number
+of entries, total size, age and scan duration as recorded by their last scan,
+and their roots.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		for _, name := range indexNames() {
+			d, err := db.OpenReadOnly(indexPath(name))
+			if err != nil {
+				log.Warn.Printf("Could not open index '%s': %s", name, err.Error())
+				continue
+			}
+			roots := rootPaths(d)
+			info, err := d.GetScanInfo()
+			if err != nil {
+				fmt.Printf("%-12s  %10s entries  %10s  %6s ago  %6s  %s\n", name, "-", "-", "-", "-", roots)
+			} else {
+				fmt.Printf("%-12s  %10d entries  %10s  %6s ago  %6s  %s\n", name, info.NEntries,
+					log.SizeString(log.ByteSize(info.Size)), shortDuration(time.Since(info.Time)),
+					shortDuration(info.Duration), roots)
+			}
+			d.Close()
+		}
+	},
+}
+
+// Duration in its largest unit, e.g. 45s, 12m, 5h or 3d
+func shortDuration(dt time.Duration) string {
+	switch {
+	case dt < time.Minute:
+		return fmt.Sprintf("%ds", int(dt.Seconds()))
+	case dt < time.Hour:
+		return fmt.Sprintf("%dm", int(dt.Minutes()))
+	case dt < 24*time.Hour:
+		return fmt.Sprintf("%dh", int(dt.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(dt.Hours()/24))
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+}
@@ -0,0 +1,58 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+
+	log "github.com/aportelli/golog"
+	"github.com/spf13/cobra"
+)
+
+// rmCmd represents the rm command
+var rmCmd = &cobra.Command{
+	Use:   "rm <name>",
+	Short: "Remove a registered index",
+	Long: `Remove the index <name> from the registry, together with its interrupted
+build and upgrade backups if any.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		name := args[0]
+		dbPath := indexPath(name)
+		_, err := os.Stat(dbPath)
+		log.ErrorCheck(err, "no index named '"+name+"'")
+		// only the exact companion files, another index may be named <name>.db
+		files := []string{}
+		for _, base := range []string{dbPath, dbPath + ".partial"} {
+			files = append(files, base, base+"-wal", base+"-shm")
+		}
+		backups, err := filepath.Glob(dbPath + ".v*.bak")
+		log.ErrorCheck(err, "")
+		for _, f := range append(files, backups...) {
+			err = os.Remove(f)
+			if !os.IsNotExist(err) {
+				log.ErrorCheck(err, "could not remove index '"+name+"'")
+			}
+		}
+		log.Msg.Printf("Removed index '%s'", name)
+	},
+}
+
+func init() {
+	rootCmd.AddCommand(rmCmd)
+}
@@ -0,0 +1,170 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/aportelli/golog"
+	"github.com/aportelli/hyperspace/index/db"
+	"github.com/spf13/cobra"
+)
+
+// snapshotCmd represents the snapshot command
+var snapshotCmd = &cobra.Command{
+	Use:   "snapshot",
+	Short: "Manage index snapshots",
+	Long: `Each indexing run records a snapshot of the directory tree. With
+'hs index --update' the entries which did not change are shared between
+snapshots and the previous versions of changed entries are kept, so that older
+snapshots can be queried.`,
+}
+
+var snapshotListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List index snapshots",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		d := openIndexDb(snapshotOpt.Db, snapshotOpt.Index, nil)
+		defer d.Close()
+		snapshots, err := d.GetSnapshots()
+		log.ErrorCheck(err, "could not get snapshots")
+		for _, s := range snapshots {
+			status := ""
+			if !s.Complete {
+				status = " (incomplete)"
+			}
+			fmt.Printf("%4d  %s  %10d entries  %10s  %s%s\n", s.Id, s.Time.Format("2006-01-02 15:04:05"), s.NEntries,
+				log.SizeString(log.ByteSize(s.Size)), s.Root, status)
+		}
+	},
+}
+
+var snapshotHistoryCmd = &cobra.Command{
+	Use:   "history [<path>]",
+	Short: "Show the size history of a directory",
+	Long: `Show the successive sizes of the directory <path> (the index root by
+default) across snapshots, with the range of snapshots for which each size is
+valid.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		d := openIndexDb(snapshotOpt.Db, snapshotOpt.Index, args)
+		defer d.Close()
+		start := ""
+		if len(args) > 0 {
+			start = args[0]
+		}
+		id := resolvePath(d, start)
+		snapshots, err := d.GetSnapshots()
+		log.ErrorCheck(err, "could not get snapshots")
+		times := make(map[int64]time.Time)
+		for _, s := range snapshots {
+			times[s.Id] = s.Time
+		}
+		versions, err := d.GetRollupHistory(id)
+		log.ErrorCheck(err, "could not get directory history")
+		for _, v := range versions {
+			date := "-"
+			if t, ok := times[v.Start]; ok {
+				date = t.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%4d-%-4d  %s  %10s  %10d files  %8d dirs\n", v.Start, v.End, date,
+				log.SizeString(log.ByteSize(v.Size)), v.NFiles, v.NDirs)
+		}
+	},
+}
+
+var snapshotPruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Delete old snapshots",
+	Long: `Delete the snapshots which are neither among the --keep-last most recent
+ones nor younger than --keep-within (e.g. 12h, 30d, 8w), at least one of which
+must be given. The latest snapshot is always kept.`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		var err error
+		opt := snapshotOpt.Prune
+		if snapshotOpt.KeepWithin != "" {
+			opt.KeepWithin, err = parseDuration(snapshotOpt.KeepWithin)
+			log.ErrorCheck(err, "")
+		}
+		if opt.KeepLast == 0 && opt.KeepWithin == 0 {
+			log.ErrorCheck(errors.New("no snapshots to keep"), "give --keep-last or --keep-within")
+		}
+		d := openIndexDb(snapshotOpt.Db, snapshotOpt.Index, nil)
+		defer d.Close()
+		pruned, err := d.PruneSnapshots(opt)
+		log.ErrorCheck(err, "could not prune snapshots")
+		log.Msg.Printf("Deleted %d snapshot(s)", len(pruned))
+	},
+}
+
+var snapshotExportCmd = &cobra.Command{
+	Use:   "export <id> <db>",
+	Short: "Export a snapshot as a standalone index",
+	Long: `Write snapshot <id> to the new index database <db>, which can then be
+queried with the --db option of other commands.`,
+	Args: cobra.ExactArgs(2),
+	Run: func(cmd *cobra.Command, args []string) {
+		d := openIndexDb(snapshotOpt.Db, snapshotOpt.Index, nil)
+		defer d.Close()
+		id, err := strconv.ParseInt(args[0], 10, 64)
+		log.ErrorCheck(err, "invalid snapshot id")
+		err = d.ExportSnapshot(id, args[1])
+		log.ErrorCheck(err, "could not export snapshot")
+	},
+}
+
+var snapshotOpt = struct {
+	Db         string
+	Index      string
+	Prune      db.PruneOpt
+	KeepWithin string
+}{}
+
+func init() {
+	rootCmd.AddCommand(snapshotCmd)
+	snapshotCmd.AddCommand(snapshotListCmd, snapshotHistoryCmd, snapshotPruneCmd, snapshotExportCmd)
+	snapshotCmd.PersistentFlags().StringVarP(&snapshotOpt.Db, "db", "d", "", "index database path")
+	snapshotCmd.PersistentFlags().StringVarP(&snapshotOpt.Index, "index", "i", "", "name of the registered index (see 'hs list')")
+	snapshotPruneCmd.Flags().UintVar(&snapshotOpt.Prune.KeepLast, "keep-last", 0, "number of most recent snapshots to keep")
+	snapshotPruneCmd.Flags().StringVar(&snapshotOpt.KeepWithin, "keep-within", "", "keep snapshots younger than this duration")
+}
+
+// Parse durations like time.ParseDuration, with additional d (day) and w
+// (week) units
+func parseDuration(s string) (time.Duration, error) {
+	units := map[string]time.Duration{"d": 24 * time.Hour, "w": 7 * 24 * time.Hour}
+	for u, mult := range units {
+		if strings.HasSuffix(s, u) {
+			v, err := strconv.ParseFloat(strings.TrimSuffix(s, u), 64)
+			if err != nil || v < 0 {
+				return 0, fmt.Errorf("invalid duration '%s'", s)
+			}
+			return time.Duration(v * float64(mult)), nil
+		}
+	}
+	dt, err := time.ParseDuration(s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid duration '%s'", s)
+	}
+	return dt, nil
+}
@@ -0,0 +1,77 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package cmd
+
+import (
+	"fmt"
+	"sort"
+
+	log "github.com/aportelli/golog"
+	"github.com/aportelli/hyperspace/index/db"
+	"github.com/spf13/cobra"
+)
+
+// topCmd represents the top command
+var topCmd = &cobra.Command{
+	Use:   "top [<path>]",
+	Short: "List the largest files or directories from the index",
+	Long: `List the largest files (or directories with --type d) below <path>
+(all the index roots by default). Directory sizes are the sizes of their whole
+subtree.`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		d := openIndexDb(topOpt.Db, topOpt.Index, args)
+		defer d.Close()
+		if topOpt.Type != "d" && topOpt.Type != "f" {
+			log.ErrorCheck(fmt.Errorf("invalid type '%s'", topOpt.Type), "type must be 'd' or 'f'")
+		}
+		entries := []db.UsageEntry{}
+		for _, id := range resolveStarts(d, args) {
+			warnExcluded(d, id)
+			largest, err := d.GetLargest(id, topOpt.Type, topOpt.Number, !topOpt.ApparentSize, topOpt.CountLinks)
+			log.ErrorCheck(err, "could not get largest entries")
+			entries = append(entries, largest...)
+		}
+		less, _ := usageLess("size", topOpt.ApparentSize, topOpt.CountLinks)
+		sort.SliceStable(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+		if len(entries) > int(topOpt.Number) {
+			entries = entries[:topOpt.Number]
+		}
+		for _, e := range entries {
+			printUsage(usageSize(e, topOpt.ApparentSize, topOpt.CountLinks), fullPath(d, e.Id))
+		}
+	},
+}
+
+var topOpt = struct {
+	Db           string
+	Index        string
+	Number       uint
+	Type         string
+	ApparentSize bool
+	CountLinks   bool
+}{}
+
+func init() {
+	rootCmd.AddCommand(topCmd)
+	topCmd.Flags().StringVarP(&topOpt.Db, "db", "d", "", "index database path")
+	topCmd.Flags().StringVarP(&topOpt.Index, "index", "i", "", "name of the registered index (see 'hs list')")
+	topCmd.Flags().UintVarP(&topOpt.Number, "number", "n", 10, "number of entries")
+	topCmd.Flags().StringVarP(&topOpt.Type, "type", "t", "f", "entry type ('d': directory, 'f': file)")
+	topCmd.Flags().BoolVarP(&topOpt.ApparentSize, "apparent-size", "A", false, "use apparent sizes instead of allocated sizes")
+	topCmd.Flags().BoolVarP(&topOpt.CountLinks, "count-links", "l", false, "count and list hard linked files once per name")
+}
@@ -17,44 +17,89 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package index
 
 import (
+	"context"
 	"sync"
+	"sync/atomic"
 
 	"github.com/aportelli/hyperspace/index/db"
 )
 
 type IndexerStats struct {
-	NFiles         uint64
-	TotalSize      uint64
-	ActiveWorkers  int32
-	QueuingWorkers int32
+	NFiles        uint64
+	TotalSize     uint64
+	NErrors       uint64
+	ActiveWorkers int32
+	QueuedDirs    int32
 }
 
 type FileIndexer struct {
-	Db         *db.IndexDb
-	stats      IndexerStats
-	NumWorkers uint
-	quitScan   chan int
-	indexWg    sync.WaitGroup
+	Db              *db.IndexDb
+	ScanOpt         ScanOpt
+	stats           IndexerStats
+	NumWorkers      uint
+	Resume          bool
+	cancel          context.CancelFunc
+	cancelMutex     sync.Mutex
+	indexWg         sync.WaitGroup
+	optionRules     *ignoreList
+	rootDev         int64
+	excluded        []string
+	excludedMutex   sync.Mutex
+	inodes          map[devIno]struct{}
+	inodesMutex     sync.Mutex
+	unfinished      []dirData
+	unfinishedMutex sync.Mutex
 }
 
 func NewFileIndexer(d *db.IndexDb, numWorkers uint) *FileIndexer {
 	s := new(FileIndexer)
 	s.NumWorkers = numWorkers
 	s.Db = d
+	s.ScanOpt.MaxDepth = -1
 	return s
 }
 
 func (s *FileIndexer) resetStats() {
-	s.stats = IndexerStats{}
+	atomic.StoreUint64(&s.stats.NFiles, 0)
+	atomic.StoreUint64(&s.stats.TotalSize, 0)
+	atomic.StoreUint64(&s.stats.NErrors, 0)
+	atomic.StoreInt32(&s.stats.ActiveWorkers, 0)
+	atomic.StoreInt32(&s.stats.QueuedDirs, 0)
 }
 
 func (s *FileIndexer) Stats() IndexerStats {
-	return s.stats
+	return IndexerStats{
+		NFiles:        atomic.LoadUint64(&s.stats.NFiles),
+		TotalSize:     atomic.LoadUint64(&s.stats.TotalSize),
+		NErrors:       atomic.LoadUint64(&s.stats.NErrors),
+		ActiveWorkers: atomic.LoadInt32(&s.stats.ActiveWorkers),
+		QueuedDirs:    atomic.LoadInt32(&s.stats.QueuedDirs),
+	}
+}
+
+// Derive the context of a scan, which is cancelled by Interrupt
+func (s *FileIndexer) startScan(ctx context.Context) context.Context {
+	s.cancelMutex.Lock()
+	defer s.cancelMutex.Unlock()
+	ctx, s.cancel = context.WithCancel(ctx)
+	return ctx
+}
+
+func (s *FileIndexer) endScan() {
+	s.cancelMutex.Lock()
+	defer s.cancelMutex.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
 }
 
+// Stop the running scan, if any. This does not wait for the scan to stop, the
+// scanning function then returns an InterruptError.
 func (s *FileIndexer) Interrupt() {
-	if s.quitScan != nil {
-		s.quitScan <- 1
-		s.indexWg.Wait()
+	s.cancelMutex.Lock()
+	defer s.cancelMutex.Unlock()
+	if s.cancel != nil {
+		s.cancel()
 	}
 }
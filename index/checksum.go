@@ -0,0 +1,173 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"context"
+	"encoding/hex"
+	gohash "hash"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/aportelli/golog"
+	"github.com/aportelli/hyperspace/index/db"
+	"github.com/aportelli/hyperspace/index/hash"
+)
+
+// Content checksum options, a negative MaxSize means no size limit and a
+// non-positive Rate (in bytes per second) means no throughput limit.
+type ChecksumOpt struct {
+	Algorithm string
+	MaxSize   int64
+	Rate      float64
+}
+
+const checksumBufferSize = 1 << 20
+
+// Compute the content checksums of all the indexed files which do not have one,
+// files which cannot be read are skipped and counted in the NErrors statistic.
+// Hard links to the same file are only read once.
+func (s *FileIndexer) ChecksumFiles(opt ChecksumOpt) error {
+	s.resetStats()
+	_, err := hash.NewContentHash(opt.Algorithm)
+	if err != nil {
+		return err
+	}
+	err = s.Db.InitChecksums(opt.Algorithm)
+	if err != nil {
+		return err
+	}
+	entries, err := s.Db.GetMissingChecksums(opt.MaxSize)
+	if err != nil {
+		return err
+	}
+	// hard links to the same inode are a single file
+	var links [][]int64
+	inodes := make(map[[2]int64]int)
+	for _, e := range entries {
+		key := [2]int64{e.Dev, e.Inode}
+		if i, ok := inodes[key]; ok && e.Inode != 0 {
+			links[i] = append(links[i], e.Id)
+			continue
+		}
+		inodes[key] = len(links)
+		links = append(links, []int64{e.Id})
+	}
+	log.Dbg.Printf("FileIndexer: %d file(s) to checksum", len(links))
+	limiter := newRateLimiter(opt.Rate)
+	cids := make(chan []int64)
+	cchecksums := make(chan db.Checksum)
+	cerrors := make(chan error, 1)
+	ctx := s.startScan(context.Background())
+	defer s.endScan()
+	s.indexWg.Add(1)
+	go func() {
+		defer s.indexWg.Done()
+		err := s.Db.WriteChecksums(cchecksums)
+		if err != nil {
+			cerrors <- err
+			s.Interrupt()
+			for range cchecksums {
+			}
+		}
+	}()
+	var wg sync.WaitGroup
+	for i := uint(0); i < s.NumWorkers || i == 0; i++ {
+		wg.Add(1)
+		go s.checksumWorker(opt.Algorithm, limiter, cids, cchecksums, &wg)
+	}
+	var ctxErr error
+out:
+	for _, ids := range links {
+		select {
+		case cids <- ids:
+		case <-ctx.Done():
+			ctxErr = ctx.Err()
+			break out
+		}
+	}
+	s.endScan()
+	close(cids)
+	wg.Wait()
+	close(cchecksums)
+	s.indexWg.Wait()
+	select {
+	case err = <-cerrors:
+		return err
+	default:
+	}
+	if ctxErr != nil {
+		return &InterruptError{Err: ctxErr, Stats: s.Stats()}
+	}
+	return nil
+}
+
+// Checksum the files received on cids, each being the ids of the hard links to
+// a file which is read once
+func (s *FileIndexer) checksumWorker(algo string, limiter *rateLimiter, cids <-chan []int64,
+	cchecksums chan<- db.Checksum, wg *sync.WaitGroup) {
+	defer wg.Done()
+	atomic.AddInt32(&s.stats.ActiveWorkers, 1)
+	h, _ := hash.NewContentHash(algo)
+	buf := make([]byte, checksumBufferSize)
+	for ids := range cids {
+		path, err := s.Db.GetFullPath(ids[0])
+		if err != nil {
+			log.Dbg.Printf("FileIndexer: cannot get path of %x: %s", ids[0], err.Error())
+			atomic.AddUint64(&s.stats.NErrors, 1)
+			continue
+		}
+		sum, n, err := checksumFile(path, h, buf, limiter)
+		if err != nil {
+			log.Dbg.Printf("FileIndexer: cannot checksum '%s': %s", path, err.Error())
+			atomic.AddUint64(&s.stats.NErrors, 1)
+			continue
+		}
+		atomic.AddUint64(&s.stats.NFiles, 1)
+		atomic.AddUint64(&s.stats.TotalSize, uint64(n))
+		for _, id := range ids {
+			cchecksums <- db.Checksum{Id: id, Checksum: sum}
+		}
+	}
+	atomic.AddInt32(&s.stats.ActiveWorkers, -1)
+}
+
+func checksumFile(path string, h gohash.Hash, buf []byte, limiter *rateLimiter) (string, int64, error) {
+	var total int64
+	f, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer f.Close()
+	h.Reset()
+	for {
+		n, err := f.Read(buf)
+		if n > 0 {
+			limiter.wait(n)
+			h.Write(buf[:n])
+			total += int64(n)
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return "", total, err
+		}
+	}
+	return hex.EncodeToString(h.Sum(nil)), total, nil
+}
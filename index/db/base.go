@@ -17,57 +17,291 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package db
 
 import (
+	"context"
 	"database/sql"
+	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
 
-	_ "github.com/mattn/go-sqlite3"
+	"github.com/aportelli/hyperspace/index/hash"
+
+	"github.com/mattn/go-sqlite3"
 )
 
 type IndexDb struct {
-	db             *sql.DB
-	insertTreeStmt *sql.Stmt
-	insertValStmt  *sql.Stmt
-	Insertions     uint64
-	BatchSize      uint
+	db                  *sql.DB
+	insertTreeStmt      *sql.Stmt
+	insertTreesStmt     *sql.Stmt
+	insertValStmt       *sql.Stmt
+	selectTreeStmt      *sql.Stmt
+	updateTreeStmt      *sql.Stmt
+	insertSeenStmt      *sql.Stmt
+	insertErrorStmt     *sql.Stmt
+	selectCollisionStmt *sql.Stmt
+	insertCollisionStmt *sql.Stmt
+	archiveTreeStmt     *sql.Stmt
+	rowsPerInsert       int
+	snapshotId          int64
+	prevSnapshotId      int64
+	Insertions          uint64
+	Updates             uint64
+	Deletions           uint64
+	Collisions          uint64
+	Hasher              hash.PathHasher
+	BatchSize           uint
+	Update              bool
+	path                string
+	buildPath           string
+	rootId              int64
+	rootNamespace       string
+	legacyRoots         bool
 }
 
+// Database options, with Update an existing index is reconciled with the
+// scanned entries instead of being rebuilt (Reset is then ignored). Hasher is
+// the path id scheme of a new index, for an existing index it must be empty or
+// match the scheme of the index. With Swap a reset index is built in a
+// temporary file next to path, which only replaces the existing database once
+// CreateIndices succeeds and is discarded if the database is closed before,
+// unless it has the checkpoint of an interrupted scan. With Resume the index of
+// an interrupted scan is opened as is, to be completed by a resumed scan.
 type IndexDbOpt struct {
 	Reset     bool
+	Update    bool
+	Swap      bool
+	Resume    bool
 	BatchSize uint
+	Hasher    string
 }
 
 func NewIndexDb(path string, opt IndexDbOpt) (*IndexDb, error) {
 	var err error
 	d := new(IndexDb)
-	if opt.Reset {
+	d.path = path
+	resumeBuild := opt.Resume && opt.Reset && opt.Swap
+	if opt.Update || opt.Resume {
+		opt.Reset = false
+	}
+	openPath := path
+	if resumeBuild {
+		d.buildPath = path + ".partial"
+		openPath = d.buildPath
+		if _, err = os.Stat(openPath); err != nil {
+			return nil, fmt.Errorf("no interrupted index build of '%s' to resume", path)
+		}
+	} else if opt.Reset && opt.Swap {
+		d.buildPath = path + ".partial"
+		d.removeBuild()
+		openPath = d.buildPath
+	} else if opt.Reset {
 		err = os.RemoveAll(path)
 		if err != nil {
 			return nil, err
 		}
 	}
-	err = d.open(path)
+	err = d.open(openPath)
 	if err != nil {
 		return nil, err
 	}
+	if opt.Update {
+		hasTables, err := d.hasTables()
+		if err != nil {
+			return nil, err
+		}
+		opt.Reset = !hasTables
+	}
 	if opt.Reset {
 		err = d.initTables()
 		if err != nil {
 			return nil, err
 		}
+	} else {
+		hasTables, err := d.hasTables()
+		if err != nil {
+			return nil, err
+		}
+		if hasTables {
+			err = d.migrate(path)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
+	if opt.Update {
+		_, err = d.db.Exec("CREATE TABLE IF NOT EXISTS update_seen (id INTEGER PRIMARY KEY)")
+		if err != nil {
+			return nil, err
+		}
+		if !opt.Resume {
+			_, err = d.db.Exec("DELETE FROM update_seen")
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	d.Update = opt.Update
 	err = d.initStatements()
 	if err != nil {
 		return nil, err
 	}
 	d.BatchSize = opt.BatchSize
+	err = d.initHasher(opt.Hasher, opt.Reset)
+	if err != nil {
+		return nil, err
+	}
+	err = d.initViews()
+	if err != nil {
+		return nil, err
+	}
 	return d, err
 }
 
+// Open an existing index database read-only to get its roots (see GetRoots,
+// FindRoot) and scan summary (see GetScanInfo), without upgrading it to the
+// current schema version. The other queries are not available.
+func OpenReadOnly(path string) (*IndexDb, error) {
+	_, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	d := new(IndexDb)
+	d.path = path
+	uri := url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro"}
+	d.db, err = sql.Open("sqlite3", uri.String())
+	if err != nil {
+		return nil, err
+	}
+	version, err := d.getSchemaVersion()
+	if err != nil {
+		d.db.Close()
+		return nil, err
+	}
+	d.legacyRoots = version < 3
+	return d, nil
+}
+
+// Set the path id scheme, recording it for a new index and checking it against
+// the recorded one otherwise. Indexes without a recorded scheme use the legacy
+// one.
+func (d *IndexDb) initHasher(name string, isNew bool) error {
+	var err error
+	if isNew {
+		if name == "" {
+			name = hash.DefaultHasher
+		}
+		d.Hasher, err = hash.NewPathHasher(name)
+		if err != nil {
+			return err
+		}
+		err = d.SetValue("hash_scheme", d.Hasher.Name())
+		if err != nil {
+			return err
+		}
+		return d.SetValue("hash_version", d.Hasher.Version())
+	}
+	stored, version := "md5-48", "1"
+	value, err := d.GetValue("hash_scheme")
+	if err == nil {
+		stored = fmt.Sprint(value)
+		value, err = d.GetValue("hash_version")
+		if err != nil {
+			return err
+		}
+		version = fmt.Sprint(value)
+	} else if err != sql.ErrNoRows {
+		return err
+	}
+	if name != "" && name != stored {
+		return fmt.Errorf("index uses the '%s' hash scheme, rebuild it to use '%s'", stored, name)
+	}
+	d.Hasher, err = hash.NewPathHasher(stored)
+	if err != nil {
+		return err
+	}
+	if version != strconv.Itoa(d.Hasher.Version()) {
+		return fmt.Errorf("index uses version %s of the '%s' hash scheme, only version %d is supported",
+			version, stored, d.Hasher.Version())
+	}
+	return nil
+}
+
+// Close the database, an index built with Swap which was not installed by
+// CreateIndices is discarded unless its scan can be resumed
 func (d *IndexDb) Close() error {
+	keep := false
+	if d.buildPath != "" {
+		keep, _ = d.HasCheckpoint()
+	}
 	err := d.db.Close()
+	if d.buildPath != "" && !keep {
+		d.removeBuild()
+	}
 	return err
 }
 
+func (d *IndexDb) removeBuild() {
+	for _, suffix := range []string{"", "-wal", "-shm"} {
+		os.Remove(d.buildPath + suffix)
+	}
+}
+
+// Replace the database at the target path with the index built in a
+// temporary file, and reopen it. The write-ahead log of the replaced database
+// is checkpointed first so that it is not applied to the new one, which fails
+// if the log is in use.
+func (d *IndexDb) install() error {
+	err := checkpointTarget(d.path)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("PRAGMA wal_checkpoint(TRUNCATE)")
+	if err != nil {
+		return err
+	}
+	err = d.db.Close()
+	if err != nil {
+		return err
+	}
+	err = os.Rename(d.buildPath, d.path)
+	if err != nil {
+		return err
+	}
+	d.removeBuild()
+	d.buildPath = ""
+	err = d.open(d.path)
+	if err != nil {
+		return err
+	}
+	return d.initStatements()
+}
+
+// Checkpoint and truncate the write-ahead log of the database at path, if any
+func checkpointTarget(path string) error {
+	_, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	target, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return err
+	}
+	defer target.Close()
+	var busy, nlog, ncheckpointed int
+	r := target.QueryRow("PRAGMA wal_checkpoint(TRUNCATE)")
+	err = r.Scan(&busy, &nlog, &ncheckpointed)
+	if err != nil {
+		return err
+	}
+	if busy != 0 {
+		return fmt.Errorf("index '%s' is in use, cannot replace it", path)
+	}
+	return nil
+}
+
 func (d *IndexDb) open(path string) error {
 	var err error
 	d.db, err = sql.Open("sqlite3", path)
@@ -86,12 +320,56 @@ func (d *IndexDb) open(path string) error {
 	if err != nil {
 		return err
 	}
+	return nil
+}
+
+func (d *IndexDb) hasTables() (bool, error) {
+	var n int
+	r := d.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'tree'")
+	err := r.Scan(&n)
 	if err != nil {
-		return err
+		return false, err
 	}
-	return nil
+	return n > 0, nil
 }
 
+// Columns of the tree table after id and parent_id, an entry row is valid
+// from snapshot snapshot_id to the latest snapshot, previous versions are moved
+// to tree_history with their last valid snapshot. The root_id column is added
+// after them by createTablesV3.
+const treeColumnsDef = `
+		path TEXT NOT NULL,
+		depth INT NOT NULL,
+		name TEXT NOT NULL,
+		type TEXT NOT NULL,
+		size INT NOT NULL,
+		mtime INT NOT NULL,
+		ctime INT NOT NULL,
+		mode INT NOT NULL,
+		uid INT NOT NULL,
+		gid INT NOT NULL,
+		dev INT NOT NULL,
+		inode INT NOT NULL,
+		nlink INT NOT NULL,
+		blocks INT NOT NULL,
+		checksum TEXT NULL,
+		target TEXT NULL,
+		dangling INT NOT NULL,
+		secondary INT NOT NULL,
+		snapshot_id INT NOT NULL`
+
+// Columns of the rollup table after id, with the same history model as tree.
+// The link_ sizes count hard links once per name.
+const rollupColumnsDef = `
+		size INT NOT NULL,
+		alloc INT NOT NULL,
+		nfiles INT NOT NULL,
+		ndirs INT NOT NULL,
+		link_size INT NOT NULL,
+		link_alloc INT NOT NULL,
+		merkle TEXT NULL,
+		snapshot_id INT NOT NULL`
+
 func (d *IndexDb) initTables() error {
 	_, err := d.db.Exec(`CREATE TABLE key_value (
 		key TEXT PRIMARY KEY,
@@ -101,31 +379,172 @@ func (d *IndexDb) initTables() error {
 	}
 	_, err = d.db.Exec(`CREATE TABLE tree (
 		id INT PRIMARY KEY,
-    parent_id INT NULL REFERENCES tree (id),
-		path TEXT NOT NULL,
-		depth INT NOT NULL,
-		name TEXT NOT NULL,
-		type TEXT NOT NULL,
-		size INT NOT NULL)`)
+    parent_id INT NULL REFERENCES tree (id),` + treeColumnsDef + `)`)
+	if err != nil {
+		return err
+	}
+	err = createTables(d.db)
+	if err != nil {
+		return err
+	}
+	err = createTablesV3(d.db)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("INSERT INTO key_value VALUES('schema_version', ?)", schemaVersion)
+	return err
+}
+
+// Create the tables added by schema version 2
+func createTables(db execer) error {
+	_, err := db.Exec(`CREATE TABLE rollup (
+		id INT PRIMARY KEY REFERENCES tree (id),` + rollupColumnsDef + `)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE snapshot (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		time INT NOT NULL,
+		root TEXT NOT NULL,
+		complete INT NOT NULL,
+		nentries INT NULL,
+		size INT NULL)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE tree_history (
+		id INT NOT NULL,
+		parent_id INT NULL,` + treeColumnsDef + `,
+		end_snapshot_id INT NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE rollup_history (
+		id INT NOT NULL,` + rollupColumnsDef + `,
+		end_snapshot_id INT NOT NULL)`)
 	if err != nil {
 		return err
 	}
-	_, err = d.db.Exec(`CREATE VIEW view_tree_hex AS
+	_, err = db.Exec(`CREATE TABLE collision (
+		id INT PRIMARY KEY,
+		nominal_id INT NOT NULL,
+		parent_id INT NOT NULL,
+		name TEXT NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec("CREATE INDEX index_collision ON collision(nominal_id, parent_id, name)")
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(`CREATE TABLE scan_errors (
+		path TEXT NOT NULL,
+		operation TEXT NOT NULL,
+		errno INT NOT NULL,
+		message TEXT NOT NULL)`)
+	return err
+}
+
+// Add the index roots of schema version 3 to the tables of version 2. The
+// root_id columns are added last so that new and upgraded databases have the
+// same column order. The views are created by initViews once the path id scheme
+// is known.
+func createTablesV3(db execer) error {
+	for _, table := range []string{"tree", "tree_history", "scan_errors"} {
+		_, err := db.Exec("ALTER TABLE " + table + " ADD COLUMN root_id INT NOT NULL DEFAULT 1")
+		if err != nil {
+			return err
+		}
+	}
+	_, err := db.Exec(`CREATE TABLE roots (
+		id INTEGER PRIMARY KEY AUTOINCREMENT,
+		path TEXT NOT NULL UNIQUE,
+		input TEXT NOT NULL,
+		excluded TEXT NOT NULL DEFAULT '',
+		max_depth INT NOT NULL DEFAULT -1,
+		legacy INT NOT NULL DEFAULT 0)`)
+	return err
+}
+
+// Definition of the view of the tree table with hexadecimal ids of the given
+// number of digits
+func viewTreeHexQuery(digits int) string {
+	return fmt.Sprintf(`CREATE VIEW view_tree_hex AS
 		SELECT
-		  printf("%012x",id) AS id,
+		  printf("%%0%[1]dx",id) AS id,
 			CASE
-			  WHEN parent_id NOT NULL THEN printf("%012x",parent_id)
+			  WHEN parent_id NOT NULL THEN printf("%%0%[1]dx",parent_id)
 				ELSE NULL
 			END parent_id,
-			path, depth, name, type, size
-		FROM tree`)
+			path, depth, name, type, size, mtime, ctime,
+			printf("%%o",mode) AS mode, uid, gid, dev, inode, nlink, blocks, checksum, target, dangling,
+			secondary, snapshot_id, root_id
+		FROM tree`, digits)
+}
 
+// Create the views, or recreate them if they do not match the current schema
+// and path id scheme
+func (d *IndexDb) initViews() error {
+	query := viewTreeHexQuery(d.Hasher.Digits())
+	var current string
+	r := d.db.QueryRow("SELECT sql FROM sqlite_master WHERE type = 'view' AND name = 'view_tree_hex'")
+	err := r.Scan(&current)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if current == query {
+		return nil
+	}
+	_, err = d.db.Exec("DROP VIEW IF EXISTS view_tree_hex")
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(query)
 	return err
 }
 
+// Columns of the tree table, in order
+const treeColumns = `id, parent_id, path, depth, name, type, size, mtime, ctime, mode, uid, gid, dev, inode,
+	nlink, blocks, checksum, target, dangling, secondary, snapshot_id, root_id`
+
+// Number of columns of the tree table
+const treeNumColumns = 22
+
+// Multi-row insertion of n entries in the tree table
+func insertTreeQuery(n int) string {
+	row := "(?" + strings.Repeat(",?", treeNumColumns-1) + ")"
+	return "INSERT INTO tree VALUES" + row + strings.Repeat(","+row, n-1)
+}
+
+// Maximum number of variables in a statement
+func (d *IndexDb) maxVariables() (int, error) {
+	n := 999
+	conn, err := d.db.Conn(context.Background())
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	err = conn.Raw(func(driverConn any) error {
+		if c, ok := driverConn.(*sqlite3.SQLiteConn); ok {
+			n = c.GetLimit(sqlite3.SQLITE_LIMIT_VARIABLE_NUMBER)
+		}
+		return nil
+	})
+	return n, err
+}
+
 func (d *IndexDb) initStatements() error {
 	var err error
-	d.insertTreeStmt, err = d.db.Prepare("INSERT INTO tree VALUES(?,?,?,?,?,?,?)")
+	d.insertTreeStmt, err = d.db.Prepare(insertTreeQuery(1))
+	if err != nil {
+		return err
+	}
+	nvars, err := d.maxVariables()
+	if err != nil {
+		return err
+	}
+	d.rowsPerInsert = nvars / treeNumColumns
+	d.insertTreesStmt, err = d.db.Prepare(insertTreeQuery(d.rowsPerInsert))
 	if err != nil {
 		return err
 	}
@@ -133,5 +552,39 @@ func (d *IndexDb) initStatements() error {
 	if err != nil {
 		return err
 	}
+	d.insertErrorStmt, err = d.db.Prepare("INSERT INTO scan_errors VALUES(?,?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	d.selectCollisionStmt, err = d.db.Prepare("SELECT id FROM collision WHERE nominal_id = ? AND parent_id = ? AND name = ?")
+	if err != nil {
+		return err
+	}
+	d.insertCollisionStmt, err = d.db.Prepare("INSERT INTO collision VALUES(?,?,?,?)")
+	if err != nil {
+		return err
+	}
+	d.selectTreeStmt, err = d.db.Prepare(`SELECT COALESCE(parent_id, -1), name, type, size, mtime, ctime,
+		COALESCE(target, '') FROM tree WHERE id = ?`)
+	if err != nil {
+		return err
+	}
+	if d.Update {
+		d.updateTreeStmt, err = d.db.Prepare(`UPDATE tree SET type = ?, size = ?, mtime = ?, ctime = ?,
+			mode = ?, uid = ?, gid = ?, dev = ?, inode = ?, nlink = ?, blocks = ?, checksum = NULL,
+			target = ?, dangling = ?, secondary = ?, snapshot_id = ? WHERE id = ?`)
+		if err != nil {
+			return err
+		}
+		d.archiveTreeStmt, err = d.db.Prepare("INSERT INTO tree_history (" + treeColumns + ", end_snapshot_id) SELECT " +
+			treeColumns + ", ? FROM tree WHERE id = ?")
+		if err != nil {
+			return err
+		}
+		d.insertSeenStmt, err = d.db.Prepare("INSERT OR IGNORE INTO update_seen VALUES(?)")
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
@@ -0,0 +1,190 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more detaild.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package db
+
+import (
+	"fmt"
+)
+
+// Directory left to scan by an interrupted scan, Path is relative to the index
+// root, HashPath is the id path of the directory and Depth the depth of its
+// children. Some of its entries may already be in the index.
+type CheckpointDir struct {
+	Id       int64
+	Path     string
+	HashPath string
+	Depth    uint
+}
+
+// Create empty checkpoint tables for a new scan. Directories whose entries are
+// all inserted are recorded in checkpoint_done by the inserter, in the same
+// transaction as their entries, and the directories left to scan are saved in
+// checkpoint_queue when the scan is interrupted. The scanned root is the
+// current one.
+func (d *IndexDb) InitCheckpoint() error {
+	err := d.ClearCheckpoint()
+	if err != nil {
+		return err
+	}
+	err = d.SetValue("checkpoint_root", d.rootId)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("CREATE TABLE checkpoint_done (id INTEGER PRIMARY KEY)")
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(`CREATE TABLE checkpoint_queue (
+		id INTEGER PRIMARY KEY,
+		path TEXT NOT NULL,
+		depth INT NOT NULL)`)
+	return err
+}
+
+// Drop the checkpoint tables
+func (d *IndexDb) ClearCheckpoint() error {
+	_, err := d.db.Exec("DROP TABLE IF EXISTS checkpoint_done")
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("DROP TABLE IF EXISTS checkpoint_queue")
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("DELETE FROM key_value WHERE key = 'checkpoint_root'")
+	return err
+}
+
+func (d *IndexDb) insertDone(dirs []*FileEntry) error {
+	for _, dir := range dirs {
+		_, err := d.db.Exec("INSERT OR IGNORE INTO checkpoint_done VALUES(?)", dir.Id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Save the directories left to scan by an interrupted scan
+func (d *IndexDb) SaveCheckpoint(dirs []CheckpointDir) error {
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM checkpoint_queue")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, dir := range dirs {
+		_, err = tx.Exec("REPLACE INTO checkpoint_queue VALUES(?,?,?)", dir.Id, dir.Path, dir.Depth)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Return whether the index has the checkpoint of an interrupted scan
+func (d *IndexDb) HasCheckpoint() (bool, error) {
+	var n int
+	r := d.db.QueryRow("SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'checkpoint_done'")
+	err := r.Scan(&n)
+	return n > 0, err
+}
+
+// Load the directories left to scan by an interrupted scan of the absolute
+// path root, and resume its root and snapshot. If the scan was killed before
+// saving its queue, the directories left to scan are the unfinished
+// directories whose parent is finished.
+func (d *IndexDb) LoadCheckpoint(root string) ([]CheckpointDir, error) {
+	ok, err := d.HasCheckpoint()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, fmt.Errorf("index has no interrupted scan to resume")
+	}
+	var rootId int64
+	r := d.db.QueryRow("SELECT COALESCE((SELECT value FROM key_value WHERE key = 'checkpoint_root'), 1)")
+	err = r.Scan(&rootId)
+	if err != nil {
+		return nil, err
+	}
+	scanned, err := d.GetRoot(rootId)
+	if err != nil {
+		return nil, err
+	}
+	if scanned.Path != root {
+		return nil, fmt.Errorf("the interrupted scan is of '%s', not '%s'", scanned.Path, root)
+	}
+	d.setRoot(scanned)
+	var n int
+	r = d.db.QueryRow("SELECT COUNT(*) FROM checkpoint_queue")
+	err = r.Scan(&n)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT q.id, q.path, t.path, q.depth FROM checkpoint_queue q JOIN tree t ON t.id = q.id
+		WHERE t.root_id = ?`
+	if n == 0 {
+		query = `SELECT t.id, NULL, t.path, t.depth + 1 FROM tree t
+			WHERE t.type = 'd' AND t.id NOT IN (SELECT id FROM checkpoint_done)
+			AND (t.parent_id IS NULL OR t.parent_id IN (SELECT id FROM checkpoint_done)) AND t.root_id = ?`
+	}
+	rows, err := d.db.Query(query, d.rootId)
+	if err != nil {
+		return nil, err
+	}
+	dirs := []CheckpointDir{}
+	for rows.Next() {
+		var dir CheckpointDir
+		var path *string
+		err = rows.Scan(&dir.Id, &path, &dir.HashPath, &dir.Depth)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if path != nil {
+			dir.Path = *path
+		}
+		dirs = append(dirs, dir)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		for i := range dirs {
+			dirs[i].Path, err = d.GetPath(dirs[i].Id)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	d.snapshotId = 0
+	err = d.loadSnapshot()
+	return dirs, err
+}
+
+// Delete the children of a directory whose scan was interrupted, so that it
+// can be scanned again from scratch
+func (d *IndexDb) DeleteChildren(id int64) error {
+	_, err := d.db.Exec("DELETE FROM tree WHERE parent_id = ?", id)
+	return err
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more detaild.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package db
+
+type Checksum struct {
+	Id       int64
+	Checksum string
+}
+
+// Prepare the content checksums for the given algorithm, all the existing
+// checksums are dropped if they were computed with a different algorithm.
+func (d *IndexDb) InitChecksums(algo string) error {
+	value, err := d.GetValue("checksum_algo")
+	if prevAlgo, ok := value.(string); err == nil && ok && prevAlgo == algo {
+		return nil
+	}
+	_, err = d.db.Exec("UPDATE tree SET checksum = NULL WHERE checksum NOT NULL")
+	if err != nil {
+		return err
+	}
+	return d.SetValue("checksum_algo", algo)
+}
+
+// Files without content checksum, of size at most maxSize if maxSize is
+// non-negative. Only the Id, Dev and Inode fields of the entries are set.
+func (d *IndexDb) GetMissingChecksums(maxSize int64) ([]FileEntry, error) {
+	query := "SELECT id, dev, inode FROM tree WHERE type = 'f' AND checksum IS NULL"
+	args := []any{}
+	if maxSize >= 0 {
+		query += " AND size <= ?"
+		args = append(args, maxSize)
+	}
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	entries := []FileEntry{}
+	for rows.Next() {
+		var e FileEntry
+		err = rows.Scan(&e.Id, &e.Dev, &e.Inode)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// Store the checksums received on c until it is closed
+func (d *IndexDb) WriteChecksums(c <-chan Checksum) error {
+	batchSize := d.BatchSize
+	if batchSize == 0 {
+		batchSize = 1
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare("UPDATE tree SET checksum = ? WHERE id = ?")
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	n := uint(0)
+	for cs := range c {
+		_, err = stmt.Exec(cs.Checksum, cs.Id)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		n++
+		if n%batchSize == 0 {
+			err = tx.Commit()
+			if err != nil {
+				return err
+			}
+			tx, err = d.db.Begin()
+			if err != nil {
+				return err
+			}
+			stmt, err = tx.Prepare("UPDATE tree SET checksum = ? WHERE id = ?")
+			if err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+	}
+	return tx.Commit()
+}
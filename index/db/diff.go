@@ -0,0 +1,188 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more detaild.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+)
+
+type DiffKind int
+
+const (
+	DiffAdded DiffKind = iota
+	DiffRemoved
+	DiffResized
+	DiffModified
+)
+
+func (k DiffKind) String() string {
+	switch k {
+	case DiffAdded:
+		return "added"
+	case DiffRemoved:
+		return "removed"
+	case DiffResized:
+		return "resized"
+	case DiffModified:
+		return "modified"
+	default:
+		return fmt.Sprintf("DiffKind(%d)", int(k))
+	}
+}
+
+// Difference of an entry between two indexes, Type is the type in the newest
+// index, or in the oldest one for removed entries.
+type DiffEntry struct {
+	Id      int64
+	Kind    DiffKind
+	Type    string
+	OldSize int64
+	NewSize int64
+}
+
+// Size difference of a directory subtree between two indexes
+type DirDelta struct {
+	Id      int64
+	Depth   uint
+	OldSize int64
+	NewSize int64
+	Removed bool
+}
+
+func (dd *DirDelta) Delta() int64 {
+	return dd.NewSize - dd.OldSize
+}
+
+// Run fn with a dedicated connection to which the database at path is attached
+// as 'other'.
+func (d *IndexDb) withAttached(path string, fn func(ctx context.Context, conn *sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := d.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.ExecContext(ctx, "ATTACH DATABASE ? AS other", path)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "DETACH DATABASE other")
+	return fn(ctx, conn)
+}
+
+// Check that the attached database uses the same path id scheme, ids being
+// meaningless across schemes. Indexes without a recorded scheme use the legacy
+// one.
+func checkHashScheme(ctx context.Context, conn *sql.Conn) error {
+	var scheme, version, otherScheme, otherVersion string
+	r := conn.QueryRowContext(ctx, `SELECT
+		COALESCE((SELECT value FROM main.key_value WHERE key = 'hash_scheme'), 'md5-48'),
+		COALESCE((SELECT value FROM main.key_value WHERE key = 'hash_version'), '1'),
+		COALESCE((SELECT value FROM other.key_value WHERE key = 'hash_scheme'), 'md5-48'),
+		COALESCE((SELECT value FROM other.key_value WHERE key = 'hash_version'), '1')`)
+	err := r.Scan(&scheme, &version, &otherScheme, &otherVersion)
+	if err != nil {
+		return err
+	}
+	if scheme != otherScheme || version != otherVersion {
+		return fmt.Errorf("indexes use different hash schemes ('%s' version %s and '%s' version %s), rebuild one of them",
+			otherScheme, otherVersion, scheme, version)
+	}
+	return nil
+}
+
+// Call fn for each entry which differs between the index at oldPath and this
+// one. Entries are matched by id, and directories are only reported when
+// added or removed. Files are resized if their size changed and modified if
+// their type, modification time or checksum changed. Both indexes must use the
+// same path id scheme.
+func (d *IndexDb) Diff(oldPath string, fn func(e DiffEntry) error) error {
+	return d.withAttached(oldPath, func(ctx context.Context, conn *sql.Conn) error {
+		err := checkHashScheme(ctx, conn)
+		if err != nil {
+			return err
+		}
+		rows, err := conn.QueryContext(ctx, `
+			SELECT n.id, 0, n.type, 0, n.size FROM main.tree n
+				WHERE NOT EXISTS (SELECT 1 FROM other.tree o WHERE o.id = n.id)
+			UNION ALL
+			SELECT o.id, 1, o.type, o.size, 0 FROM other.tree o
+				WHERE NOT EXISTS (SELECT 1 FROM main.tree n WHERE n.id = o.id)
+			UNION ALL
+			SELECT n.id, CASE WHEN n.size != o.size THEN 2 ELSE 3 END, n.type, o.size, n.size
+				FROM main.tree n JOIN other.tree o ON o.id = n.id
+				WHERE (n.type != 'd' OR o.type != 'd') AND (n.size != o.size OR n.type != o.type
+					OR n.mtime != o.mtime OR COALESCE(n.checksum != o.checksum, 0))`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var e DiffEntry
+			err = rows.Scan(&e.Id, &e.Kind, &e.Type, &e.OldSize, &e.NewSize)
+			if err != nil {
+				return err
+			}
+			err = fn(e)
+			if err != nil {
+				return err
+			}
+		}
+		return rows.Err()
+	})
+}
+
+// Size differences of the directories up to depth maxDepth (no limit if
+// negative) between the index at oldPath and this one, using the directory
+// rollups. Directories which did not change are not reported. Both indexes
+// must use the same path id scheme.
+func (d *IndexDb) DiffDirs(oldPath string, maxDepth int) ([]DirDelta, error) {
+	deltas := []DirDelta{}
+	err := d.withAttached(oldPath, func(ctx context.Context, conn *sql.Conn) error {
+		err := checkHashScheme(ctx, conn)
+		if err != nil {
+			return err
+		}
+		rows, err := conn.QueryContext(ctx, `
+			SELECT n.id, n.depth, COALESCE(ro.size, 0), rn.size, 0
+				FROM main.tree n JOIN main.rollup rn ON rn.id = n.id
+				LEFT JOIN other.rollup ro ON ro.id = n.id
+				WHERE (? < 0 OR n.depth <= ?) AND (ro.size IS NULL OR ro.size != rn.size)
+			UNION ALL
+			SELECT o.id, o.depth, ro.size, 0, 1
+				FROM other.tree o JOIN other.rollup ro ON ro.id = o.id
+				WHERE (? < 0 OR o.depth <= ?)
+					AND NOT EXISTS (SELECT 1 FROM main.rollup rn WHERE rn.id = o.id)`,
+			maxDepth, maxDepth, maxDepth, maxDepth)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var dd DirDelta
+			err = rows.Scan(&dd.Id, &dd.Depth, &dd.OldSize, &dd.NewSize, &dd.Removed)
+			if err != nil {
+				return err
+			}
+			deltas = append(deltas, dd)
+		}
+		return rows.Err()
+	})
+	return deltas, err
+}
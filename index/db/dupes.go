@@ -0,0 +1,67 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more detaild.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package db
+
+// Set of files with identical content, or of directories with identical
+// subtrees, in which case Checksum is the Merkle hash of the subtree.
+type DuplicateSet struct {
+	Size     int64
+	Checksum string
+	Ids      []int64
+}
+
+// Space freed by keeping a single copy of the set
+func (ds *DuplicateSet) Reclaimable() int64 {
+	return ds.Size * int64(len(ds.Ids)-1)
+}
+
+// Call fn for each group of at least two files of equal size (at least
+// minSize). Only the id, size, device, inode and checksum of the entries are
+// set.
+func (d *IndexDb) GetSizeGroups(minSize int64, fn func(group []FileEntry) error) error {
+	rows, err := d.db.Query(`SELECT id, size, dev, inode, COALESCE(checksum, '') FROM tree
+		WHERE type = 'f' AND size >= ? AND size IN
+			(SELECT size FROM tree WHERE type = 'f' AND size >= ? GROUP BY size HAVING COUNT(*) > 1)
+		ORDER BY size, id`, minSize, minSize)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	group := []FileEntry{}
+	for rows.Next() {
+		var e FileEntry
+		err = rows.Scan(&e.Id, &e.Size, &e.Dev, &e.Inode, &e.Checksum)
+		if err != nil {
+			return err
+		}
+		if len(group) > 0 && group[0].Size != e.Size {
+			err = fn(group)
+			if err != nil {
+				return err
+			}
+			group = []FileEntry{}
+		}
+		group = append(group, e)
+	}
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	if len(group) > 1 {
+		return fn(group)
+	}
+	return nil
+}
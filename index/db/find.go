@@ -0,0 +1,101 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more detaild.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package db
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Search criteria for Find, a negative bound means no bound. Depths are
+// relative to the start entry. Dangling restricts the search to symbolic links
+// with a missing target.
+type FindOpt struct {
+	Start    int64
+	Glob     string
+	Regex    *regexp.Regexp
+	Type     string
+	MinSize  int64
+	MaxSize  int64
+	MinDepth int
+	MaxDepth int
+	Dangling bool
+}
+
+func NewFindOpt(start int64) FindOpt {
+	return FindOpt{Start: start, MinSize: -1, MaxSize: -1, MinDepth: -1, MaxDepth: -1}
+}
+
+// Call fn with the id and name of every entry in the subtree of opt.Start
+// (included) matching the criteria in opt.
+func (d *IndexDb) Find(opt FindOpt, fn func(id int64, name string) error) error {
+	start, err := d.GetEntry(opt.Start)
+	if err != nil {
+		return err
+	}
+	cond, args := subtreeCondition(start)
+	where := []string{cond}
+	if opt.Glob != "" {
+		where = append(where, "name GLOB ?")
+		args = append(args, opt.Glob)
+	}
+	if opt.Type != "" {
+		where = append(where, "type = ?")
+		args = append(args, opt.Type)
+	}
+	if opt.Dangling {
+		where = append(where, "type = 'l' AND dangling = 1")
+	}
+	if opt.MinSize >= 0 {
+		where = append(where, "size >= ?")
+		args = append(args, opt.MinSize)
+	}
+	if opt.MaxSize >= 0 {
+		where = append(where, "size <= ?")
+		args = append(args, opt.MaxSize)
+	}
+	if opt.MinDepth >= 0 {
+		where = append(where, "depth >= ?")
+		args = append(args, start.Depth+uint(opt.MinDepth))
+	}
+	if opt.MaxDepth >= 0 {
+		where = append(where, "depth <= ?")
+		args = append(args, start.Depth+uint(opt.MaxDepth))
+	}
+	query := "SELECT id, name FROM tree t WHERE " + strings.Join(where, " AND ") + " ORDER BY path"
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var name string
+		err = rows.Scan(&id, &name)
+		if err != nil {
+			return err
+		}
+		if opt.Regex != nil && !opt.Regex.MatchString(name) {
+			continue
+		}
+		err = fn(id, name)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
@@ -16,10 +16,35 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 */
 package db
 
+// Create the query indices, this also installs an index built with the Swap
+// option in place of the previous database.
 func (d *IndexDb) CreateIndices() error {
-	_, err := d.db.Exec("CREATE INDEX index_path ON tree(path)")
+	_, err := d.db.Exec("CREATE INDEX IF NOT EXISTS index_path ON tree(path)")
 	if err != nil {
 		return err
 	}
+	_, err = d.db.Exec("CREATE INDEX IF NOT EXISTS index_parent ON tree(parent_id)")
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("CREATE INDEX IF NOT EXISTS index_tree_history ON tree_history(id)")
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("CREATE INDEX IF NOT EXISTS index_rollup_history ON rollup_history(id)")
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("CREATE INDEX IF NOT EXISTS index_rollup_size ON rollup(size)")
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("CREATE INDEX IF NOT EXISTS index_rollup_alloc ON rollup(alloc)")
+	if err != nil {
+		return err
+	}
+	if d.buildPath != "" {
+		return d.install()
+	}
 	return nil
 }
@@ -17,27 +17,58 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package db
 
 import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 
 	log "github.com/aportelli/golog"
-	"golang.org/x/text/unicode/norm"
+	"github.com/mattn/go-sqlite3"
 )
 
 type FileEntry struct {
-	Id       int64
-	ParentId any
-	Path     string
-	Depth    uint
-	Name     string
-	Type     string
-	Size     int64
+	Id        int64
+	ParentId  any
+	Path      string
+	Depth     uint
+	Name      string
+	Type      string
+	Size      int64
+	Mtime     int64
+	Ctime     int64
+	Mode      uint32
+	Uid       uint32
+	Gid       uint32
+	Dev       int64
+	Inode     int64
+	Nlink     int64
+	Blocks    int64
+	Checksum  string
+	Target    string
+	Dangling  bool
+	Secondary bool
+	Parent    *FileEntry
 }
 
+// Entries sent to the inserter at once, Done holds the entries of the
+// directories whose entries are all sent with this batch or earlier ones. The
+// batch must not be modified once sent, and the inserter sets the ids and paths
+// of its entries, which differ from the nominal ones in case of a collision.
+type EntryBatch struct {
+	Entries []*FileEntry
+	Done    []*FileEntry
+}
+
+// Channels of the inserter. Entry names must be NFC-normalised by the sender
+// and the parent of an entry must be sent before it. Quit must be closed once
+// all entries are sent, entries still buffered in Entries are then inserted.
 type InsertChan struct {
-	Entries <-chan *FileEntry
-	Quit    <-chan struct{}
-	Errors  chan<- error
+	Entries    <-chan EntryBatch
+	ScanErrors <-chan *ScanError
+	Quit       <-chan struct{}
+	Errors     chan<- error
 }
 
 func (d *IndexDb) begin() error {
@@ -50,42 +81,334 @@ func (d *IndexDb) commit() error {
 	return err
 }
 
-func (d *IndexDb) insertTree(entry *FileEntry) error {
+func (d *IndexDb) execInsertTree(entry *FileEntry) error {
 	_, err := d.insertTreeStmt.Exec(entry.Id, entry.ParentId, entry.Path, entry.Depth, entry.Name,
-		entry.Type, entry.Size)
+		entry.Type, entry.Size, entry.Mtime, entry.Ctime, entry.Mode, entry.Uid, entry.Gid, entry.Dev,
+		entry.Inode, entry.Nlink, entry.Blocks, nullString(entry.Checksum), nullString(entry.Target),
+		entry.Dangling, entry.Secondary, d.snapshotId, d.rootId)
+	if err != nil {
+		return err
+	}
 	atomic.AddUint64(&d.Insertions, 1)
+	return nil
+}
+
+// Insert a new entry, an id already used by another path is resolved as a
+// collision. Inserting an entry which is already in the index is an error.
+func (d *IndexDb) insertTree(entry *FileEntry) error {
+	d.resolveParent(entry)
+	err := d.execInsertTree(entry)
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+		t, err2 := d.selectTree(entry.Id)
+		if err2 != nil {
+			return err2
+		}
+		if t.parentId == parentKey(entry.ParentId) && t.name == entry.Name {
+			return err
+		}
+		err = d.resolveCollision(entry)
+		if err != nil {
+			return err
+		}
+		err = d.execInsertTree(entry)
+	}
 	return err
 }
 
+// Insert new entries with multi-row statements, falling back to one statement
+// per entry to resolve collisions if an id is already used, see insertTree.
+func (d *IndexDb) insertTrees(entries []*FileEntry) error {
+	for len(entries) > 0 {
+		n := len(entries)
+		if n > d.rowsPerInsert {
+			n = d.rowsPerInsert
+		}
+		chunk := entries[:n]
+		entries = entries[n:]
+		args := make([]any, 0, n*treeNumColumns)
+		for _, entry := range chunk {
+			d.resolveParent(entry)
+			args = append(args, entry.Id, entry.ParentId, entry.Path, entry.Depth, entry.Name, entry.Type,
+				entry.Size, entry.Mtime, entry.Ctime, entry.Mode, entry.Uid, entry.Gid, entry.Dev, entry.Inode,
+				entry.Nlink, entry.Blocks, nullString(entry.Checksum), nullString(entry.Target), entry.Dangling,
+				entry.Secondary, d.snapshotId, d.rootId)
+		}
+		var err error
+		if n == d.rowsPerInsert {
+			_, err = d.insertTreesStmt.Exec(args...)
+		} else {
+			_, err = d.db.Exec(insertTreeQuery(n), args...)
+		}
+		var sqliteErr sqlite3.Error
+		if errors.As(err, &sqliteErr) && sqliteErr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey {
+			for _, entry := range chunk {
+				err = d.insertTree(entry)
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		atomic.AddUint64(&d.Insertions, uint64(n))
+	}
+	return nil
+}
+
+func nullString(s string) any {
+	if s == "" {
+		return nil
+	}
+	return s
+}
+
+// Parent id used in the collision table, -1 for the root
+func parentKey(parentId any) int64 {
+	if id, ok := parentId.(int64); ok {
+		return id
+	}
+	return -1
+}
+
+// Set the parent id and path of an entry from its parent entry, whose id may
+// have changed because of a collision.
+func (d *IndexDb) resolveParent(entry *FileEntry) {
+	if entry.Parent == nil {
+		return
+	}
+	entry.ParentId = entry.Parent.Id
+	if entry.Parent.Path == "" {
+		entry.Path = d.Hasher.HashToString(entry.Id)
+	} else {
+		entry.Path = entry.Parent.Path + "/" + d.Hasher.HashToString(entry.Id)
+	}
+}
+
+// Move an entry whose id is used by another path to an alternative id. The
+// alternative ids of a given id are tried in a fixed order, and the chosen one
+// is recorded in the collision table so that it is reused by later updates.
+func (d *IndexDb) resolveCollision(entry *FileEntry) error {
+	nominalId := entry.Id
+	parentId := parentKey(entry.ParentId)
+	r := d.selectCollisionStmt.QueryRow(nominalId, parentId, entry.Name)
+	err := r.Scan(&entry.Id)
+	if err == sql.ErrNoRows {
+		for k := 1; ; k++ {
+			var n int
+			entry.Id = d.Hasher.StepHash(nominalId, "\x00"+strconv.Itoa(k))
+			r = d.db.QueryRow(`SELECT (SELECT COUNT(*) FROM tree WHERE id = ?1)
+				+ (SELECT COUNT(*) FROM collision WHERE id = ?1)`, entry.Id)
+			err = r.Scan(&n)
+			if err != nil {
+				return err
+			}
+			if n == 0 {
+				break
+			}
+		}
+		_, err = d.insertCollisionStmt.Exec(entry.Id, nominalId, parentId, entry.Name)
+	}
+	if err != nil {
+		return err
+	}
+	entry.Path = entry.Path[:strings.LastIndex(entry.Path, "/")+1] + d.Hasher.HashToString(entry.Id)
+	atomic.AddUint64(&d.Collisions, 1)
+	log.Dbg.Printf("IndexDb: id %x of '%s' collides, using %x", nominalId, entry.Name, entry.Id)
+	return nil
+}
+
+type treeRow struct {
+	parentId int64
+	name     string
+	fileType string
+	size     int64
+	mtime    int64
+	ctime    int64
+	target   string
+}
+
+func (d *IndexDb) selectTree(id int64) (*treeRow, error) {
+	t := new(treeRow)
+	r := d.selectTreeStmt.QueryRow(id)
+	err := r.Scan(&t.parentId, &t.name, &t.fileType, &t.size, &t.mtime, &t.ctime, &t.target)
+	if err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Insert a new entry or update an existing one if its type, size,
+// modification or change time, or symbolic link target changed, and mark it
+// as seen. The previous version of an updated entry is moved to the history.
+func (d *IndexDb) upsertTree(entry *FileEntry) error {
+	d.resolveParent(entry)
+	t, err := d.selectTree(entry.Id)
+	if err == nil && (t.parentId != parentKey(entry.ParentId) || t.name != entry.Name) {
+		err = d.resolveCollision(entry)
+		if err != nil {
+			return err
+		}
+		t, err = d.selectTree(entry.Id)
+	}
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	_, err2 := d.insertSeenStmt.Exec(entry.Id)
+	if err2 != nil {
+		return err2
+	}
+	if err == sql.ErrNoRows {
+		return d.execInsertTree(entry)
+	}
+	if t.fileType != entry.Type || t.size != entry.Size || t.mtime != entry.Mtime || t.ctime != entry.Ctime ||
+		t.target != entry.Target {
+		_, err = d.archiveTreeStmt.Exec(d.prevSnapshotId, entry.Id)
+		if err != nil {
+			return err
+		}
+		_, err = d.updateTreeStmt.Exec(entry.Type, entry.Size, entry.Mtime, entry.Ctime, entry.Mode,
+			entry.Uid, entry.Gid, entry.Dev, entry.Inode, entry.Nlink, entry.Blocks, nullString(entry.Target),
+			entry.Dangling, entry.Secondary, d.snapshotId, entry.Id)
+		atomic.AddUint64(&d.Updates, 1)
+	}
+	return err
+}
+
+// Delete all entries of the current root which were not seen during an update,
+// this must only be called once the whole tree has been scanned. Entries whose
+// scan failed are kept with their subtree, see keepFailed. Deleted entries are
+// moved to the history.
+func (d *IndexDb) DeleteUnseen() error {
+	err := d.keepFailed()
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec(`INSERT INTO tree_history (`+treeColumns+`, end_snapshot_id) SELECT `+treeColumns+`, ?
+		FROM tree WHERE root_id = ? AND id NOT IN (SELECT id FROM update_seen)`, d.prevSnapshotId, d.rootId)
+	if err != nil {
+		return err
+	}
+	res, err := d.db.Exec("DELETE FROM tree WHERE root_id = ? AND id NOT IN (SELECT id FROM update_seen)",
+		d.rootId)
+	if err != nil {
+		return err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	atomic.AddUint64(&d.Deletions, uint64(n))
+	return nil
+}
+
+// Mark as seen the indexed entries of the current root on which a scan error
+// was recorded, and their subtrees, so that a directory which could not be read
+// is kept as it was instead of being deleted.
+func (d *IndexDb) keepFailed() error {
+	rows, err := d.db.Query("SELECT DISTINCT path FROM scan_errors WHERE root_id = ?", d.rootId)
+	if err != nil {
+		return err
+	}
+	var paths []string
+	for rows.Next() {
+		var path string
+		err = rows.Scan(&path)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		paths = append(paths, path)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, path := range paths {
+		id, err := d.resolveId(d.rootNamespace, path)
+		if err != nil {
+			log.Dbg.Printf("IndexDb: failed entry '%s' not in the index: %s", path, err.Error())
+			continue
+		}
+		// '0' follows '/' in the byte order, so the range holds the subtree, the
+		// root entry having an empty path
+		_, err = d.db.Exec(`INSERT OR IGNORE INTO update_seen SELECT ?1
+			UNION ALL SELECT t.id FROM tree t, (SELECT path FROM tree WHERE id = ?1) p
+				WHERE t.root_id = ?2 AND (p.path = '' OR (t.path > p.path || '/' AND t.path < p.path || '0'))`,
+			id, d.rootId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Drop the update bookkeeping table
+func (d *IndexDb) EndUpdate() error {
+	_, err := d.db.Exec("DROP TABLE IF EXISTS update_seen")
+	return err
+}
+
+// Insert or update the received entries until Quit is closed, committing a
+// transaction every BatchSize entries. Finished directories are recorded in the
+// checkpoint in the same transaction as their entries.
 func (d *IndexDb) InsertData(c InsertChan, wg *sync.WaitGroup) {
-	var err error
 	defer wg.Done()
 	log.Dbg.Println("FileIndexer: Inserter started")
-	for {
-		err = d.begin()
+	check := func(err error) {
 		if err != nil {
 			c.Errors <- err
 		}
-		for i := uint(0); i < d.BatchSize; i++ {
-			select {
-			case fileEntry := <-c.Entries:
-				fileEntry.Name = norm.NFC.String(fileEntry.Name)
-				err = d.insertTree(fileEntry)
-				if err != nil {
-					c.Errors <- err
-				}
-			case <-c.Quit:
-				err = d.commit()
-				if err != nil {
-					c.Errors <- err
-				}
-				log.Dbg.Println("FileIndexer: Inserter quitting")
-				return
+	}
+	// directories are only recorded as done once their entry is inserted, so
+	// that their id is resolved
+	var pending, pendingDone []*FileEntry
+	flush := func() {
+		check(d.insertTrees(pending))
+		check(d.insertDone(pendingDone))
+		pending = pending[:0]
+		pendingDone = pendingDone[:0]
+	}
+	n := uint(0)
+	receive := func(b EntryBatch) {
+		entries := b.Entries
+		if d.Update {
+			for _, entry := range entries {
+				check(d.upsertTree(entry))
+			}
+		} else {
+			pending = append(pending, entries...)
+			if len(pending) >= d.rowsPerInsert {
+				full := len(pending) - len(pending)%d.rowsPerInsert
+				check(d.insertTrees(pending[:full]))
+				pending = append(pending[:0], pending[full:]...)
 			}
 		}
-		err = d.commit()
-		if err != nil {
-			c.Errors <- err
+		pendingDone = append(pendingDone, b.Done...)
+		n += uint(len(entries))
+	}
+	check(d.begin())
+	for {
+		select {
+		case b := <-c.Entries:
+			receive(b)
+		case scanError := <-c.ScanErrors:
+			check(d.insertScanError(scanError))
+		case <-c.Quit:
+			for len(c.Entries) > 0 {
+				receive(<-c.Entries)
+			}
+			flush()
+			check(d.commit())
+			log.Dbg.Println("FileIndexer: Inserter quitting")
+			return
+		}
+		if n >= d.BatchSize {
+			flush()
+			check(d.commit())
+			check(d.begin())
+			n = 0
 		}
 	}
 }
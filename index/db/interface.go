@@ -17,12 +17,13 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package db
 
 import (
+	"database/sql"
 	"fmt"
 	"path/filepath"
 	"strconv"
 	"strings"
 
-	"github.com/aportelli/hyperspace/index/hash"
+	"golang.org/x/text/unicode/norm"
 )
 
 func (d *IndexDb) GetParentId(id int64) (int64, error) {
@@ -52,6 +53,9 @@ func (d *IndexDb) GetPath(id int64) (string, error) {
 	if err != nil {
 		return "", err
 	}
+	if idPath == "" {
+		return "", nil
+	}
 	split := strings.Split(idPath, "/")
 	splitId, err := strconv.ParseInt("0x"+split[0], 0, 64)
 	if err != nil {
@@ -75,21 +79,37 @@ func (d *IndexDb) GetPath(id int64) (string, error) {
 	return path, nil
 }
 
+// Get the id of a path, an absolute path being resolved in the root containing
+// it and a relative path in the default root (see defaultRoot)
 func (d *IndexDb) GetId(path string) (int64, error) {
+	var root int64
 	var relPath string
 	if filepath.IsAbs(path) {
-		root, err := d.GetValue("root_abs")
+		r, rel, err := d.FindRoot(path)
 		if err != nil {
 			return 0, err
 		}
-		relPath, err = filepath.Rel(root.(string), path)
+		root, relPath = r.Id, rel
+	} else {
+		var err error
+		root, err = d.defaultRoot()
 		if err != nil {
 			return 0, err
 		}
-	} else {
 		relPath = filepath.Clean(path)
 	}
-	id, err := hash.PathHash(relPath)
+	namespace, err := d.getRootNamespace(root)
+	if err != nil {
+		return 0, err
+	}
+	hasCollisions, err := d.hasCollisions()
+	if err != nil {
+		return 0, err
+	}
+	if hasCollisions {
+		return d.resolveId(namespace, relPath)
+	}
+	id, err := d.Hasher.RootPathHash(namespace, relPath)
 	if err != nil {
 		return 0, err
 	}
@@ -97,8 +117,87 @@ func (d *IndexDb) GetId(path string) (int64, error) {
 	if err != nil {
 		return 0, err
 	}
-	if name != filepath.Base(path) {
-		return 0, fmt.Errorf("id %x has name %s, expected %s", id, name, filepath.Base(path))
+	expName := filepath.Base(relPath)
+	if relPath == "." {
+		expName = ""
+	}
+	if name != expName {
+		return 0, fmt.Errorf("id %x has name %s, expected %s", id, name, expName)
+	}
+	return id, nil
+}
+
+func (d *IndexDb) hasCollisions() (bool, error) {
+	var n int
+	r := d.db.QueryRow("SELECT EXISTS (SELECT 1 FROM collision)")
+	err := r.Scan(&n)
+	return n > 0, err
+}
+
+// Resolve a path relative to a root with the given id namespace to an id
+// component by component, following the alternative ids of colliding entries.
+func (d *IndexDb) resolveId(namespace string, relPath string) (int64, error) {
+	id, err := d.Hasher.RootPathHash(namespace, "")
+	if err != nil {
+		return 0, err
+	}
+	relPath = norm.NFC.String(filepath.Clean(relPath))
+	if relPath == "." {
+		return id, nil
+	}
+	prefix := ""
+	for _, name := range strings.Split(filepath.ToSlash(relPath), "/") {
+		parentId := id
+		if prefix == "" {
+			prefix = name
+		} else {
+			prefix += "/" + name
+		}
+		id, err = d.Hasher.RootPathHash(namespace, prefix)
+		if err != nil {
+			return 0, err
+		}
+		found, err := d.isChild(id, parentId, name)
+		if err != nil {
+			return 0, err
+		}
+		if !found {
+			r := d.selectCollisionStmt.QueryRow(id, parentId, name)
+			err = r.Scan(&id)
+			if err != nil && err != sql.ErrNoRows {
+				return 0, err
+			}
+			if err == nil {
+				found, err = d.isChild(id, parentId, name)
+				if err != nil {
+					return 0, err
+				}
+			}
+		}
+		if !found {
+			return 0, fmt.Errorf("'%s' not found", prefix)
+		}
 	}
 	return id, nil
 }
+
+func (d *IndexDb) isChild(id int64, parentId int64, name string) (bool, error) {
+	var n int
+	r := d.db.QueryRow("SELECT COUNT(*) FROM tree WHERE id = ? AND parent_id = ? AND name = ?", id, parentId, name)
+	err := r.Scan(&n)
+	return n > 0, err
+}
+
+func (d *IndexDb) GetEntry(id int64) (*FileEntry, error) {
+	e := new(FileEntry)
+	r := d.db.QueryRow(`SELECT id, parent_id, path, depth, name, type, size, mtime, ctime, mode, uid,
+		gid, dev, inode, nlink, blocks, COALESCE(checksum, ''), COALESCE(target, ''), dangling,
+		secondary FROM tree WHERE id = ?`, id)
+	err := r.Scan(&e.Id, &e.ParentId, &e.Path, &e.Depth, &e.Name, &e.Type, &e.Size, &e.Mtime,
+		&e.Ctime, &e.Mode, &e.Uid, &e.Gid, &e.Dev, &e.Inode, &e.Nlink, &e.Blocks, &e.Checksum,
+		&e.Target, &e.Dangling, &e.Secondary)
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
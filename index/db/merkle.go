@@ -0,0 +1,185 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more detaild.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package db
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	gohash "hash"
+)
+
+// Compute the Merkle hash of every directory and store it in the rollup table.
+// The hash of a directory is computed over the name-sorted list of its
+// children names, types, sizes, content checksums (when available) and link
+// targets for files, and Merkle hashes for directories. The name of the
+// directory itself is not included, so identical subtrees have identical
+// hashes wherever they are. The number of regular files hashed without a
+// content checksum, i.e. only by name and size, is returned.
+func (d *IndexDb) ComputeMerkleHashes() (int64, error) {
+	var missing int64
+	tx, err := d.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	stmt, err := tx.Prepare("UPDATE rollup SET merkle = ? WHERE id = ?")
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer stmt.Close()
+	rows, err := d.db.Query(`SELECT id, parent_id, depth, name, type, size, COALESCE(checksum, ''),
+		COALESCE(target, '') FROM tree WHERE parent_id NOT NULL ORDER BY depth DESC, parent_id, name`)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	defer rows.Close()
+
+	// only the hashes of the current and previous depth levels are kept
+	emptyHash := hex.EncodeToString(sha256.New().Sum(nil))
+	childHashes := make(map[int64]string)
+	levelHashes := make(map[int64]string)
+	var h gohash.Hash
+	var currentDepth uint
+	var currentParent int64
+	store := func(id int64, merkle string) error {
+		_, err := stmt.Exec(merkle, id)
+		return err
+	}
+	finalize := func() error {
+		if h == nil {
+			return nil
+		}
+		levelHashes[currentParent] = hex.EncodeToString(h.Sum(nil))
+		return store(currentParent, levelHashes[currentParent])
+	}
+	for rows.Next() {
+		var id, parentId, size int64
+		var depth uint
+		var name, fileType, checksum, target string
+		err = rows.Scan(&id, &parentId, &depth, &name, &fileType, &size, &checksum, &target)
+		if err != nil {
+			tx.Rollback()
+			return 0, err
+		}
+		if h == nil || depth != currentDepth || parentId != currentParent {
+			err = finalize()
+			if err != nil {
+				tx.Rollback()
+				return 0, err
+			}
+			if h != nil && depth != currentDepth {
+				childHashes = levelHashes
+				levelHashes = make(map[int64]string)
+			}
+			h = sha256.New()
+			currentDepth = depth
+			currentParent = parentId
+		}
+		if fileType == "d" {
+			merkle, ok := childHashes[id]
+			if !ok {
+				merkle = emptyHash
+				err = store(id, merkle)
+				if err != nil {
+					tx.Rollback()
+					return 0, err
+				}
+			}
+			fmt.Fprintf(h, "%s\x00d\x00%s\n", name, merkle)
+		} else {
+			if fileType == "f" && checksum == "" {
+				missing++
+			}
+			fmt.Fprintf(h, "%s\x00%s\x00%d\x00%s\x00%s\n", name, fileType, size, checksum, target)
+		}
+	}
+	if err = rows.Err(); err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	err = finalize()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	return missing, tx.Commit()
+}
+
+// Sets of non-empty directories with identical Merkle hashes, sorted by
+// decreasing size. Sets nested in a larger set (i.e. their members have
+// distinct parents which all belong to the same set) are not reported.
+func (d *IndexDb) GetDuplicateDirs() ([]DuplicateSet, error) {
+	rows, err := d.db.Query(`SELECT r.id, t.parent_id, r.size, r.merkle FROM rollup r JOIN tree t ON t.id = r.id
+		WHERE r.nfiles > 0 AND r.merkle IN
+			(SELECT merkle FROM rollup WHERE nfiles > 0 GROUP BY merkle HAVING COUNT(*) > 1)
+		ORDER BY r.size DESC, r.merkle, r.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	merkles := make(map[int64]string)
+	parents := make(map[int64]*int64)
+	sets := []DuplicateSet{}
+	setIndex := make(map[string]int)
+	for rows.Next() {
+		var id, size int64
+		var parentId *int64
+		var merkle string
+		err = rows.Scan(&id, &parentId, &size, &merkle)
+		if err != nil {
+			return nil, err
+		}
+		merkles[id] = merkle
+		parents[id] = parentId
+		i, ok := setIndex[merkle]
+		if !ok {
+			i = len(sets)
+			setIndex[merkle] = i
+			sets = append(sets, DuplicateSet{Size: size, Checksum: merkle})
+		}
+		sets[i].Ids = append(sets[i].Ids, id)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	result := []DuplicateSet{}
+	for _, set := range sets {
+		nested := true
+		var parentMerkle string
+		seen := make(map[int64]bool)
+		for i, id := range set.Ids {
+			p := parents[id]
+			if p == nil || seen[*p] {
+				nested = false
+				break
+			}
+			seen[*p] = true
+			m, ok := merkles[*p]
+			if !ok || (i > 0 && m != parentMerkle) {
+				nested = false
+				break
+			}
+			parentMerkle = m
+		}
+		if !nested {
+			result = append(result, set)
+		}
+	}
+	return result, nil
+}
@@ -0,0 +1,197 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more detaild.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	log "github.com/aportelli/golog"
+)
+
+// Version of the database schema created by this version of hyperspace,
+// databases without a recorded version have version 1.
+const schemaVersion = 3
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// Upgrade of a database to version, run in a transaction which also records
+// the new version. The post function, if any, is run after the transaction.
+type migration struct {
+	version int
+	migrate func(tx *sql.Tx) error
+	post    func(d *IndexDb) error
+}
+
+var migrations = []migration{
+	{version: 2, migrate: migrateV2, post: postMigrateV2},
+	{version: 3, migrate: migrateV3},
+}
+
+func (d *IndexDb) getSchemaVersion() (int, error) {
+	var value string
+	r := d.db.QueryRow("SELECT value FROM key_value WHERE key = 'schema_version'")
+	err := r.Scan(&value)
+	if err == sql.ErrNoRows {
+		return 1, nil
+	} else if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(value)
+}
+
+// Upgrade the database at path to the current schema version, after saving a
+// copy of it next to the original.
+func (d *IndexDb) migrate(path string) error {
+	version, err := d.getSchemaVersion()
+	if err != nil {
+		return err
+	}
+	if version > schemaVersion {
+		return fmt.Errorf("index database has schema version %d, this version of hyperspace only supports "+
+			"versions up to %d", version, schemaVersion)
+	}
+	if version == schemaVersion {
+		return nil
+	}
+	backup := fmt.Sprintf("%s.v%d.bak", path, version)
+	log.Msg.Printf("Upgrading index database from schema version %d to %d, backup saved in '%s'",
+		version, schemaVersion, backup)
+	err = os.RemoveAll(backup)
+	if err != nil {
+		return err
+	}
+	_, err = d.db.Exec("VACUUM INTO ?", backup)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if m.version <= version {
+			continue
+		}
+		tx, err := d.db.Begin()
+		if err != nil {
+			return err
+		}
+		err = m.migrate(tx)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration to schema version %d failed: %s", m.version, err.Error())
+		}
+		_, err = tx.Exec("REPLACE INTO key_value VALUES('schema_version', ?)", m.version)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		err = tx.Commit()
+		if err != nil {
+			return err
+		}
+		if m.post != nil {
+			err = m.post(d)
+			if err != nil {
+				return fmt.Errorf("migration to schema version %d failed: %s", m.version, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// Version 1 indexes only have entry names, types and sizes, and the children of
+// the root have depth 0 unless the index was built by a version using the
+// current depths. The metadata columns are added with zero values and
+// will be filled by the next update, the existing tree becomes the first
+// snapshot.
+func migrateV2(tx *sql.Tx) error {
+	columns := []string{
+		"mtime INT NOT NULL DEFAULT 0",
+		"ctime INT NOT NULL DEFAULT 0",
+		"mode INT NOT NULL DEFAULT 0",
+		"uid INT NOT NULL DEFAULT 0",
+		"gid INT NOT NULL DEFAULT 0",
+		"dev INT NOT NULL DEFAULT 0",
+		"inode INT NOT NULL DEFAULT 0",
+		"nlink INT NOT NULL DEFAULT 0",
+		"blocks INT NOT NULL DEFAULT 0",
+		"checksum TEXT NULL",
+		"target TEXT NULL",
+		"dangling INT NOT NULL DEFAULT 0",
+		"secondary INT NOT NULL DEFAULT 0",
+		"snapshot_id INT NOT NULL DEFAULT 1",
+	}
+	for _, c := range columns {
+		_, err := tx.Exec("ALTER TABLE tree ADD COLUMN " + c)
+		if err != nil {
+			return err
+		}
+	}
+	// indexes built without a schema version may already have the children of
+	// the root at depth 1
+	_, err := tx.Exec(`UPDATE tree SET depth = depth + 1 WHERE parent_id IS NOT NULL
+		AND EXISTS (SELECT 1 FROM tree c JOIN tree r ON r.id = c.parent_id WHERE r.parent_id IS NULL AND c.depth = 0)`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DROP VIEW IF EXISTS view_tree_hex")
+	if err != nil {
+		return err
+	}
+	err = createTables(tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO snapshot VALUES(1, ?, COALESCE((SELECT value FROM key_value WHERE key = 'root_abs'), ''),
+		1, NULL, NULL)`, time.Now().UnixNano())
+	return err
+}
+
+func postMigrateV2(d *IndexDb) error {
+	err := d.ComputeRollups()
+	if err != nil {
+		return err
+	}
+	return d.CreateIndices()
+}
+
+// Root of an index with a schema version older than 3, as a row of the roots
+// table
+const legacyRootSelect = `SELECT 1, value,
+		COALESCE((SELECT value FROM key_value WHERE key = 'root_input'), value),
+		COALESCE((SELECT value FROM key_value WHERE key = 'excluded'), ''),
+		COALESCE((SELECT value FROM key_value WHERE key = 'max_depth'), -1), 1
+		FROM key_value WHERE key = 'root_abs'`
+
+// Version 2 indexes have a single root, recorded with its scan options in
+// key_value, which becomes the first root. All entries and scan errors belong
+// to it, and it is marked as legacy so that its ids are unchanged.
+func migrateV3(tx *sql.Tx) error {
+	err := createTablesV3(tx)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("INSERT INTO roots " + legacyRootSelect)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM key_value WHERE key IN ('root_abs', 'root_input', 'excluded', 'max_depth')")
+	return err
+}
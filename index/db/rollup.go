@@ -0,0 +1,174 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more detaild.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package db
+
+import (
+	"database/sql"
+)
+
+// Cumulative statistics of a directory subtree, the directory itself
+// included in the sizes. Alloc is the allocated size in bytes. Files with
+// several hard links are counted once in Size and Alloc, and once per name in
+// LinkSize and LinkAlloc.
+type Rollup struct {
+	Id        int64
+	Size      int64
+	Alloc     int64
+	NFiles    int64
+	NDirs     int64
+	LinkSize  int64
+	LinkAlloc int64
+}
+
+// Compute the rollups of all directories and store them in the rollup table.
+// Among the names of a file with several hard links, the primary one which
+// accounts for the file size is kept if it still exists, otherwise the name
+// with the smallest id becomes primary. The rollups are computed by the
+// database one depth level at a time, from the deepest, so that the tree is
+// never loaded in memory.
+func (d *IndexDb) ComputeRollups() error {
+	err := d.loadSnapshot()
+	if err != nil {
+		return err
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return err
+	}
+	err = d.computeRollups(tx)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func (d *IndexDb) computeRollups(tx *sql.Tx) error {
+	// hard links
+	_, err := tx.Exec("CREATE TEMP TABLE rollup_primary (id INTEGER PRIMARY KEY)")
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO temp.rollup_primary
+		SELECT COALESCE(MIN(CASE WHEN NOT secondary THEN id END), MIN(id)) FROM tree
+		WHERE type != 'd' AND nlink > 1 AND parent_id NOT NULL GROUP BY dev, inode`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE tree SET secondary = NOT secondary
+		WHERE type != 'd' AND nlink > 1 AND parent_id NOT NULL
+			AND secondary = (id IN (SELECT id FROM temp.rollup_primary))`)
+	if err != nil {
+		return err
+	}
+
+	// direct contributions
+	_, err = tx.Exec(`CREATE TEMP TABLE rollup_new (
+		id INTEGER PRIMARY KEY,
+		parent_id INT,
+		depth INT NOT NULL,
+		size INT NOT NULL,
+		alloc INT NOT NULL,
+		nfiles INT NOT NULL,
+		ndirs INT NOT NULL,
+		link_size INT NOT NULL,
+		link_alloc INT NOT NULL)`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO temp.rollup_new
+		SELECT t.id, t.parent_id, t.depth, t.size + COALESCE(c.size, 0), 512*t.blocks + COALESCE(c.alloc, 0),
+			COALESCE(c.nfiles, 0), COALESCE(c.ndirs, 0), t.size + COALESCE(c.link_size, 0),
+			512*t.blocks + COALESCE(c.link_alloc, 0)
+		FROM tree t LEFT JOIN (SELECT parent_id,
+				SUM(CASE WHEN type != 'd' AND (nlink <= 1 OR NOT secondary) THEN size ELSE 0 END) AS size,
+				SUM(CASE WHEN type != 'd' AND (nlink <= 1 OR NOT secondary) THEN 512*blocks ELSE 0 END) AS alloc,
+				SUM(type != 'd') AS nfiles, SUM(type = 'd') AS ndirs,
+				SUM(CASE WHEN type != 'd' THEN size ELSE 0 END) AS link_size,
+				SUM(CASE WHEN type != 'd' THEN 512*blocks ELSE 0 END) AS link_alloc
+			FROM tree WHERE parent_id NOT NULL GROUP BY parent_id) c ON c.parent_id = t.id
+		WHERE t.type = 'd'`)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("CREATE INDEX temp.index_rollup_new_depth ON rollup_new(depth)")
+	if err != nil {
+		return err
+	}
+
+	// bottom-up propagation
+	var maxDepth uint
+	r := tx.QueryRow("SELECT COALESCE(MAX(depth), 0) FROM temp.rollup_new")
+	err = r.Scan(&maxDepth)
+	if err != nil {
+		return err
+	}
+	for depth := maxDepth; depth > 0; depth-- {
+		_, err = tx.Exec(`UPDATE temp.rollup_new SET size = rollup_new.size + c.size,
+				alloc = rollup_new.alloc + c.alloc, nfiles = rollup_new.nfiles + c.nfiles,
+				ndirs = rollup_new.ndirs + c.ndirs, link_size = rollup_new.link_size + c.link_size,
+				link_alloc = rollup_new.link_alloc + c.link_alloc
+			FROM (SELECT parent_id, SUM(size) AS size, SUM(alloc) AS alloc, SUM(nfiles) AS nfiles,
+					SUM(ndirs) AS ndirs, SUM(link_size) AS link_size, SUM(link_alloc) AS link_alloc
+				FROM temp.rollup_new WHERE depth = ? AND parent_id NOT NULL GROUP BY parent_id) c
+			WHERE rollup_new.id = c.parent_id`, depth)
+		if err != nil {
+			return err
+		}
+	}
+
+	// storage, changed and removed rollups are moved to the history
+	unchanged := `EXISTS (SELECT 1 FROM temp.rollup_new n WHERE n.id = rollup.id AND n.size = rollup.size
+		AND n.alloc = rollup.alloc AND n.nfiles = rollup.nfiles AND n.ndirs = rollup.ndirs
+		AND n.link_size = rollup.link_size AND n.link_alloc = rollup.link_alloc)`
+	_, err = tx.Exec("INSERT INTO rollup_history SELECT *, ? FROM rollup WHERE NOT "+unchanged, d.prevSnapshotId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec("DELETE FROM rollup WHERE NOT " + unchanged)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`INSERT INTO rollup SELECT id, size, alloc, nfiles, ndirs, link_size, link_alloc, NULL, ?
+		FROM temp.rollup_new n WHERE NOT EXISTS (SELECT 1 FROM rollup WHERE id = n.id)`, d.snapshotId)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(`UPDATE snapshot SET nentries = (SELECT COUNT(*) FROM tree),
+		size = (SELECT SUM(r.size) FROM rollup r JOIN tree t ON t.id = r.id WHERE t.parent_id IS NULL)
+		WHERE id = ?`, d.snapshotId)
+	if err != nil {
+		return err
+	}
+	for _, table := range []string{"rollup_primary", "rollup_new"} {
+		_, err = tx.Exec("DROP TABLE temp." + table)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *IndexDb) GetRollup(id int64) (*Rollup, error) {
+	r := new(Rollup)
+	row := d.db.QueryRow("SELECT id, size, alloc, nfiles, ndirs, link_size, link_alloc FROM rollup WHERE id = ?", id)
+	err := row.Scan(&r.Id, &r.Size, &r.Alloc, &r.NFiles, &r.NDirs, &r.LinkSize, &r.LinkAlloc)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
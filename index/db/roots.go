@@ -0,0 +1,209 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more detaild.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package db
+
+import (
+	"database/sql"
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// Indexed directory, Path is absolute and Input is the path given to the
+// indexer. Excluded holds the root-relative paths of the subtrees excluded
+// from the last scan of the root, and MaxDepth its depth limit (negative for
+// none).
+type Root struct {
+	Id       int64
+	Path     string
+	Input    string
+	Excluded []string
+	MaxDepth int
+	legacy   bool
+}
+
+type rowScanner interface {
+	Scan(dest ...any) error
+}
+
+const rootSelect = "SELECT id, path, input, excluded, max_depth, legacy FROM roots"
+
+func scanRoot(r rowScanner) (*Root, error) {
+	root := new(Root)
+	var excluded string
+	err := r.Scan(&root.Id, &root.Path, &root.Input, &excluded, &root.MaxDepth, &root.legacy)
+	if err != nil {
+		return nil, err
+	}
+	if excluded != "" {
+		root.Excluded = strings.Split(excluded, "\n")
+	}
+	return root, nil
+}
+
+// Id namespace of the root, see hash.PathHasher.RootPathHash. A root uses its
+// path so that it has the same ids in all the indexes containing it, except
+// the root of an index predating multiple roots which keeps its ids in the
+// empty namespace.
+func (r *Root) namespace() string {
+	if r.legacy {
+		return ""
+	}
+	return r.Path
+}
+
+// Make the absolute path the root of the entries inserted from now on, adding
+// it to the index if needed
+func (d *IndexDb) SetRoot(path string, input string) error {
+	_, err := d.db.Exec(`INSERT INTO roots (path, input) VALUES(?1, ?2)
+		ON CONFLICT(path) DO UPDATE SET input = ?2`, path, input)
+	if err != nil {
+		return err
+	}
+	root, err := scanRoot(d.db.QueryRow(rootSelect+" WHERE path = ?", path))
+	if err != nil {
+		return err
+	}
+	d.setRoot(root)
+	return nil
+}
+
+func (d *IndexDb) setRoot(root *Root) {
+	d.rootId = root.Id
+	d.rootNamespace = root.namespace()
+}
+
+// Id namespace of the root with the given id, empty if the index has no roots
+func (d *IndexDb) getRootNamespace(id int64) (string, error) {
+	r, err := d.GetRoot(id)
+	if err == sql.ErrNoRows {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return r.namespace(), nil
+}
+
+// Record the excluded subtrees and the depth limit of the scan of the current
+// root
+func (d *IndexDb) SetRootScan(excluded []string, maxDepth int) error {
+	_, err := d.db.Exec("UPDATE roots SET excluded = ?, max_depth = ? WHERE id = ?",
+		strings.Join(excluded, "\n"), maxDepth, d.rootId)
+	return err
+}
+
+// Get the roots of the index, in the order they were added
+func (d *IndexDb) GetRoots() ([]Root, error) {
+	query := rootSelect + " ORDER BY id"
+	if d.legacyRoots {
+		query = legacyRootSelect
+	}
+	rows, err := d.db.Query(query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	roots := []Root{}
+	for rows.Next() {
+		root, err := scanRoot(rows)
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, *root)
+	}
+	return roots, rows.Err()
+}
+
+func (d *IndexDb) GetRoot(id int64) (*Root, error) {
+	return scanRoot(d.db.QueryRow(rootSelect+" WHERE id = ?", id))
+}
+
+// Get the root an entry belongs to
+func (d *IndexDb) GetEntryRoot(id int64) (*Root, error) {
+	return scanRoot(d.db.QueryRow(rootSelect+" WHERE id = (SELECT root_id FROM tree WHERE id = ?)", id))
+}
+
+// Get the root containing an absolute path, the innermost one if roots are
+// nested, and the path relative to it
+func (d *IndexDb) FindRoot(path string) (*Root, string, error) {
+	roots, err := d.GetRoots()
+	if err != nil {
+		return nil, "", err
+	}
+	path = filepath.Clean(path)
+	var found *Root
+	for i, r := range roots {
+		rel, err := filepath.Rel(r.Path, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if found == nil || len(r.Path) > len(found.Path) {
+			found = &roots[i]
+		}
+	}
+	if found == nil {
+		return nil, "", fmt.Errorf("'%s' is not in any root of the index", path)
+	}
+	rel, err := filepath.Rel(found.Path, path)
+	return found, rel, err
+}
+
+// Id of the top directory of a root
+func (d *IndexDb) GetRootEntryId(root int64) (int64, error) {
+	var id int64
+	r := d.db.QueryRow("SELECT id FROM tree WHERE root_id = ? AND parent_id IS NULL", root)
+	err := r.Scan(&id)
+	return id, err
+}
+
+// Root against which relative paths are resolved, the current root if one is
+// set and the only root of the index otherwise
+func (d *IndexDb) defaultRoot() (int64, error) {
+	if d.rootId != 0 {
+		return d.rootId, nil
+	}
+	roots, err := d.GetRoots()
+	if err != nil {
+		return 0, err
+	}
+	switch len(roots) {
+	case 0:
+		return 1, nil
+	case 1:
+		return roots[0].Id, nil
+	default:
+		return 0, fmt.Errorf("index has %d roots, relative paths are ambiguous", len(roots))
+	}
+}
+
+// Hash of a path relative to the current root
+func (d *IndexDb) RootPathHash(path string) (int64, error) {
+	return d.Hasher.RootPathHash(d.rootNamespace, path)
+}
+
+// Absolute path of an entry
+func (d *IndexDb) GetFullPath(id int64) (string, error) {
+	root, err := d.GetEntryRoot(id)
+	if err != nil {
+		return "", err
+	}
+	path, err := d.GetPath(id)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(root.Path, path), nil
+}
@@ -0,0 +1,61 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more detaild.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package db
+
+// Error encountered while scanning an entry, Path is relative to the index
+// root and Errno is 0 if the error does not come from a system call. Root is
+// the absolute path of the root, it is set by GetScanErrors.
+type ScanError struct {
+	Root      string
+	Path      string
+	Operation string
+	Errno     int
+	Message   string
+}
+
+func (d *IndexDb) insertScanError(e *ScanError) error {
+	_, err := d.insertErrorStmt.Exec(e.Path, e.Operation, e.Errno, e.Message, d.rootId)
+	return err
+}
+
+// Delete the errors of the previous scan of the current root
+func (d *IndexDb) ClearScanErrors() error {
+	_, err := d.db.Exec("DELETE FROM scan_errors WHERE root_id = ?", d.rootId)
+	return err
+}
+
+// Call fn for each error of the last scan of every root, ordered by path
+func (d *IndexDb) GetScanErrors(fn func(e ScanError) error) error {
+	rows, err := d.db.Query(`SELECT r.path, e.path, e.operation, e.errno, e.message
+		FROM scan_errors e JOIN roots r ON r.id = e.root_id ORDER BY r.path, e.path`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var e ScanError
+		err = rows.Scan(&e.Root, &e.Path, &e.Operation, &e.Errno, &e.Message)
+		if err != nil {
+			return err
+		}
+		err = fn(e)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
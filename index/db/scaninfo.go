@@ -0,0 +1,78 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more detaild.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package db
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Summary of the last scan of an index, Time is the end of the scan. NEntries
+// and Size cover all the roots of the index.
+type ScanInfo struct {
+	Time     time.Time
+	Duration time.Duration
+	NEntries int64
+	Size     int64
+}
+
+// Record in key_value the summary of a scan which ended at end and lasted
+// duration, the rollups must be computed first
+func (d *IndexDb) RecordScan(end time.Time, duration time.Duration) error {
+	var nentries, size int64
+	r := d.db.QueryRow(`SELECT (SELECT COUNT(*) FROM tree),
+		COALESCE((SELECT SUM(r.size) FROM rollup r JOIN tree t ON t.id = r.id WHERE t.parent_id IS NULL), 0)`)
+	err := r.Scan(&nentries, &size)
+	if err != nil {
+		return err
+	}
+	values := map[string]int64{
+		"scan_time":     end.UnixNano(),
+		"scan_duration": int64(duration),
+		"nentries":      nentries,
+		"size":          size,
+	}
+	for key, value := range values {
+		err = d.SetValue(key, value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Get the summary of the last scan recorded by RecordScan
+func (d *IndexDb) GetScanInfo() (*ScanInfo, error) {
+	values := make(map[string]int64)
+	for _, key := range []string{"scan_time", "scan_duration", "nentries", "size"} {
+		value, err := d.GetValue(key)
+		if err != nil {
+			return nil, err
+		}
+		values[key], err = strconv.ParseInt(fmt.Sprint(value), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return &ScanInfo{
+		Time:     time.Unix(0, values["scan_time"]),
+		Duration: time.Duration(values["scan_duration"]),
+		NEntries: values["nentries"],
+		Size:     values["size"],
+	}, nil
+}
@@ -0,0 +1,250 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more detaild.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package db
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Index snapshot, Root is the root whose scan created it. NEntries and Size
+// cover all the roots of the index and are only known once rollups have been
+// computed.
+type Snapshot struct {
+	Id       int64
+	Time     time.Time
+	Root     string
+	Complete bool
+	NEntries int64
+	Size     int64
+}
+
+// Rollup of a directory valid from snapshot Start to snapshot End included
+type RollupVersion struct {
+	Rollup
+	Start int64
+	End   int64
+}
+
+// Snapshot retention policy, a snapshot is kept if it is among the KeepLast
+// most recent ones or if it is younger than KeepWithin. The latest snapshot of
+// each root is always kept.
+type PruneOpt struct {
+	KeepLast   uint
+	KeepWithin time.Duration
+}
+
+// Start a new snapshot of root, entries inserted or updated from now on
+// belong to it.
+func (d *IndexDb) BeginSnapshot(root string) error {
+	r := d.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM snapshot")
+	err := r.Scan(&d.prevSnapshotId)
+	if err != nil {
+		return err
+	}
+	res, err := d.db.Exec("INSERT INTO snapshot (time, root, complete) VALUES(?,?,0)",
+		time.Now().UnixNano(), root)
+	if err != nil {
+		return err
+	}
+	d.snapshotId, err = res.LastInsertId()
+	return err
+}
+
+// Mark the current snapshot as complete
+func (d *IndexDb) EndSnapshot() error {
+	_, err := d.db.Exec("UPDATE snapshot SET complete = 1 WHERE id = ?", d.snapshotId)
+	return err
+}
+
+// Set the current and previous snapshots to the latest ones in the database
+// if no snapshot was started.
+func (d *IndexDb) loadSnapshot() error {
+	if d.snapshotId != 0 {
+		return nil
+	}
+	r := d.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM snapshot")
+	err := r.Scan(&d.snapshotId)
+	if err != nil {
+		return err
+	}
+	r = d.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM snapshot WHERE id < ?", d.snapshotId)
+	return r.Scan(&d.prevSnapshotId)
+}
+
+func (d *IndexDb) GetSnapshots() ([]Snapshot, error) {
+	rows, err := d.db.Query(`SELECT id, time, root, complete, COALESCE(nentries, 0), COALESCE(size, 0)
+		FROM snapshot ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	snapshots := make([]Snapshot, 0)
+	for rows.Next() {
+		var s Snapshot
+		var t int64
+		err = rows.Scan(&s.Id, &t, &s.Root, &s.Complete, &s.NEntries, &s.Size)
+		if err != nil {
+			return nil, err
+		}
+		s.Time = time.Unix(0, t)
+		snapshots = append(snapshots, s)
+	}
+	return snapshots, rows.Err()
+}
+
+// Get all the recorded rollups of a directory, oldest first
+func (d *IndexDb) GetRollupHistory(id int64) ([]RollupVersion, error) {
+	rows, err := d.db.Query(`
+		SELECT id, size, alloc, nfiles, ndirs, link_size, link_alloc, snapshot_id, end_snapshot_id
+			FROM rollup_history WHERE id = ?
+		UNION ALL
+		SELECT id, size, alloc, nfiles, ndirs, link_size, link_alloc, snapshot_id, (SELECT MAX(id) FROM snapshot)
+			FROM rollup WHERE id = ?
+		ORDER BY snapshot_id`, id, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	versions := make([]RollupVersion, 0)
+	for rows.Next() {
+		var v RollupVersion
+		err = rows.Scan(&v.Id, &v.Size, &v.Alloc, &v.NFiles, &v.NDirs, &v.LinkSize, &v.LinkAlloc, &v.Start, &v.End)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// Delete the snapshots not kept by the retention policy together with the
+// history entries which are not part of any remaining snapshot, and return
+// the ids of the deleted snapshots.
+func (d *IndexDb) PruneSnapshots(opt PruneOpt) ([]int64, error) {
+	snapshots, err := d.GetSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	pruned := make([]int64, 0)
+	now := time.Now()
+	latest := make(map[string]bool)
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		s := snapshots[i]
+		rank := uint(len(snapshots) - i)
+		if !latest[s.Root] || rank <= opt.KeepLast || now.Sub(s.Time) < opt.KeepWithin {
+			latest[s.Root] = true
+			continue
+		}
+		pruned = append(pruned, s.Id)
+	}
+	if len(pruned) == 0 {
+		return pruned, nil
+	}
+	tx, err := d.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range pruned {
+		_, err = tx.Exec("DELETE FROM snapshot WHERE id = ?", id)
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	for _, table := range []string{"tree_history", "rollup_history"} {
+		_, err = tx.Exec(fmt.Sprintf(`DELETE FROM %s WHERE NOT EXISTS (SELECT 1 FROM snapshot s
+			WHERE s.id BETWEEN %s.snapshot_id AND %s.end_snapshot_id)`, table, table, table))
+		if err != nil {
+			tx.Rollback()
+			return nil, err
+		}
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	_, err = d.db.Exec("VACUUM")
+	return pruned, err
+}
+
+// Write snapshot id as a standalone index database at path
+func (d *IndexDb) ExportSnapshot(id int64, path string) error {
+	var count int
+	r := d.db.QueryRow("SELECT COUNT(*) FROM snapshot WHERE id = ?", id)
+	err := r.Scan(&count)
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return fmt.Errorf("no snapshot with id %d", id)
+	}
+	_, err = os.Stat(path)
+	if err == nil {
+		return fmt.Errorf("file '%s' already exists", path)
+	}
+	out, err := NewIndexDb(path, IndexDbOpt{Reset: true, Hasher: d.Hasher.Name()})
+	if err != nil {
+		return err
+	}
+	out.Close()
+	err = d.withAttached(path, func(ctx context.Context, conn *sql.Conn) error {
+		queries := []string{
+			"REPLACE INTO other.key_value SELECT * FROM main.key_value",
+			"INSERT INTO other.snapshot SELECT * FROM main.snapshot WHERE id = ?1",
+			"INSERT INTO other.collision SELECT * FROM main.collision",
+			"INSERT INTO other.roots SELECT * FROM main.roots",
+			`INSERT INTO other.tree SELECT * FROM main.tree WHERE snapshot_id <= ?1
+				UNION ALL SELECT ` + historyColumns("tree") + ` FROM main.tree_history
+				WHERE ?1 BETWEEN snapshot_id AND end_snapshot_id`,
+			`INSERT INTO other.rollup SELECT * FROM main.rollup WHERE snapshot_id <= ?1
+				UNION ALL SELECT ` + historyColumns("rollup") + ` FROM main.rollup_history
+				WHERE ?1 BETWEEN snapshot_id AND end_snapshot_id`,
+		}
+		for _, q := range queries {
+			_, err := conn.ExecContext(ctx, q, id)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	out, err = NewIndexDb(path, IndexDbOpt{Reset: false})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return out.CreateIndices()
+}
+
+// Columns of a history table without end_snapshot_id
+func historyColumns(table string) string {
+	switch table {
+	case "tree":
+		return treeColumns
+	case "rollup":
+		return "id, size, alloc, nfiles, ndirs, link_size, link_alloc, merkle, snapshot_id"
+	default:
+		return "*"
+	}
+}
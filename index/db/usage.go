@@ -0,0 +1,150 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more detaild.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package db
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Disk usage of an entry, for a directory the sizes and counts are the ones of
+// its whole subtree. Alloc is the allocated size in bytes. Hard links are
+// counted once in Size and Alloc, and once per name in LinkSize and LinkAlloc.
+type UsageEntry struct {
+	Id        int64
+	Name      string
+	Type      string
+	Depth     uint
+	Size      int64
+	Alloc     int64
+	NFiles    int64
+	NDirs     int64
+	LinkSize  int64
+	LinkAlloc int64
+}
+
+const usageSelect = `SELECT t.id, t.name, t.type, t.depth,
+		COALESCE(r.size, t.size), COALESCE(r.alloc, 512*t.blocks),
+		COALESCE(r.nfiles, CASE WHEN t.type = 'd' THEN 0 ELSE 1 END), COALESCE(r.ndirs, 0),
+		COALESCE(r.link_size, t.size), COALESCE(r.link_alloc, 512*t.blocks)
+	FROM tree t LEFT JOIN rollup r ON r.id = t.id`
+
+// SQL condition (on table alias t) restricting a query to the subtree of start
+func subtreeCondition(start *FileEntry) (string, []any) {
+	if start.Path == "" {
+		return "t.root_id = (SELECT root_id FROM tree WHERE id = ?)", []any{start.Id}
+	}
+	return "(t.path = ? OR t.path LIKE ?)", []any{start.Path, start.Path + "/%"}
+}
+
+func scanUsage(rows *sql.Rows) ([]UsageEntry, error) {
+	defer rows.Close()
+	entries := []UsageEntry{}
+	for rows.Next() {
+		var e UsageEntry
+		err := rows.Scan(&e.Id, &e.Name, &e.Type, &e.Depth, &e.Size, &e.Alloc, &e.NFiles, &e.NDirs,
+			&e.LinkSize, &e.LinkAlloc)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (d *IndexDb) GetUsage(id int64) (*UsageEntry, error) {
+	rows, err := d.db.Query(usageSelect+" WHERE t.id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := scanUsage(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 {
+		return nil, sql.ErrNoRows
+	}
+	return &entries[0], nil
+}
+
+func (d *IndexDb) GetChildrenUsage(id int64) ([]UsageEntry, error) {
+	rows, err := d.db.Query(usageSelect+" WHERE t.parent_id = ?", id)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsage(rows)
+}
+
+// Usage of all the entries in the subtree of start with a relative depth
+// between 1 and maxDepth.
+func (d *IndexDb) GetSubtreeUsage(start int64, maxDepth uint) ([]UsageEntry, error) {
+	s, err := d.GetEntry(start)
+	if err != nil {
+		return nil, err
+	}
+	cond, args := subtreeCondition(s)
+	args = append(args, s.Depth, s.Depth+maxDepth)
+	rows, err := d.db.Query(usageSelect+" WHERE "+cond+" AND t.depth > ? AND t.depth <= ?", args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsage(rows)
+}
+
+// Largest n entries of the given type in the subtree of start, sorted by
+// allocated size if alloc is true, apparent size otherwise. If links is true,
+// directory sizes count hard links once per name and a hard-linked file is
+// listed under all its names, otherwise under one of them only.
+func (d *IndexDb) GetLargest(start int64, fileType string, n uint, alloc bool, links bool) ([]UsageEntry, error) {
+	s, err := d.GetEntry(start)
+	if err != nil {
+		return nil, err
+	}
+	cond, args := subtreeCondition(s)
+	var query string
+	if fileType == "d" {
+		column := "size"
+		if alloc {
+			column = "alloc"
+		}
+		order := "r." + column
+		if links {
+			order = "r.link_" + column
+		}
+		query = fmt.Sprintf(`SELECT t.id, t.name, t.type, t.depth, r.size, r.alloc, r.nfiles, r.ndirs,
+				r.link_size, r.link_alloc
+			FROM rollup r JOIN tree t ON t.id = r.id WHERE %s ORDER BY %s DESC LIMIT ?`, cond, order)
+	} else {
+		order := "t.size"
+		if alloc {
+			order = "t.blocks"
+		}
+		where := cond + " AND t.type != 'd'"
+		if !links {
+			where += fmt.Sprintf(` AND (t.nlink <= 1 OR t.id IN (SELECT MIN(t.id) FROM tree t
+				WHERE %s AND t.nlink > 1 GROUP BY t.dev, t.inode))`, cond)
+			args = append(args, args...)
+		}
+		query = fmt.Sprintf("%s WHERE %s ORDER BY %s DESC LIMIT ?", usageSelect, where, order)
+	}
+	args = append(args, n)
+	rows, err := d.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	return scanUsage(rows)
+}
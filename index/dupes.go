@@ -0,0 +1,235 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"sort"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/aportelli/golog"
+	"github.com/aportelli/hyperspace/index/db"
+	"github.com/aportelli/hyperspace/index/hash"
+)
+
+type DupesOpt struct {
+	Algorithm string
+	MinSize   int64
+}
+
+const partialBlockSize = 4096
+
+// Find duplicate files in the index. Files are first grouped by size, then by
+// a hash of their first and last blocks, and only the remaining candidates are
+// read entirely. The full content checksums are stored in the index so that
+// later searches do not read the files again. The sets are sorted by
+// decreasing reclaimable space.
+func (s *FileIndexer) FindDuplicates(opt DupesOpt) ([]db.DuplicateSet, error) {
+	var status int
+	s.resetStats()
+	_, err := hash.NewContentHash(opt.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	err = s.Db.InitChecksums(opt.Algorithm)
+	if err != nil {
+		return nil, err
+	}
+	cgroups := make(chan []db.FileEntry)
+	csets := make(chan db.DuplicateSet)
+	cchecksums := make(chan db.Checksum)
+	cerrors := make(chan error, 1)
+	ctx := s.startScan(context.Background())
+	defer s.endScan()
+	s.indexWg.Add(1)
+	go func() {
+		defer s.indexWg.Done()
+		err := s.Db.WriteChecksums(cchecksums)
+		if err != nil {
+			cerrors <- err
+			for range cchecksums {
+			}
+		}
+	}()
+	sets := []db.DuplicateSet{}
+	setsDone := make(chan struct{})
+	go func() {
+		for set := range csets {
+			sets = append(sets, set)
+		}
+		close(setsDone)
+	}()
+	var wg sync.WaitGroup
+	for i := uint(0); i < s.NumWorkers || i == 0; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			atomic.AddInt32(&s.stats.ActiveWorkers, 1)
+			for group := range cgroups {
+				s.processSizeGroup(opt.Algorithm, group, cchecksums, csets)
+			}
+			atomic.AddInt32(&s.stats.ActiveWorkers, -1)
+		}()
+	}
+	err = s.Db.GetSizeGroups(opt.MinSize, func(group []db.FileEntry) error {
+		select {
+		case cgroups <- group:
+			return nil
+		case <-ctx.Done():
+			status = 1
+			return &InterruptError{}
+		}
+	})
+	s.endScan()
+	close(cgroups)
+	wg.Wait()
+	close(csets)
+	close(cchecksums)
+	s.indexWg.Wait()
+	<-setsDone
+	if err != nil && status == 0 {
+		return nil, err
+	}
+	select {
+	case err = <-cerrors:
+		return nil, err
+	default:
+	}
+	sort.Slice(sets, func(i, j int) bool { return sets[i].Reclaimable() > sets[j].Reclaimable() })
+	if status == 1 {
+		return sets, &InterruptError{}
+	}
+	return sets, nil
+}
+
+func (s *FileIndexer) processSizeGroup(algo string, group []db.FileEntry,
+	cchecksums chan<- db.Checksum, csets chan<- db.DuplicateSet) {
+	// hard links to the same inode are a single file
+	inodes := make(map[[2]int64]bool)
+	files := []*db.FileEntry{}
+	unknown := 0
+	for i := range group {
+		e := &group[i]
+		key := [2]int64{e.Dev, e.Inode}
+		if e.Inode != 0 && inodes[key] {
+			continue
+		}
+		inodes[key] = true
+		files = append(files, e)
+		if e.Checksum == "" {
+			unknown++
+		}
+	}
+	if len(files) < 2 {
+		return
+	}
+	size := files[0].Size
+	paths := make(map[int64]string)
+	getPath := func(id int64) (string, error) {
+		path, ok := paths[id]
+		if !ok {
+			var err error
+			path, err = s.Db.GetFullPath(id)
+			if err != nil {
+				return "", err
+			}
+			paths[id] = path
+		}
+		return path, nil
+	}
+
+	// partial hashes, useless if all the full checksums are already known or
+	// if the files are small enough. Files with a known checksum are only read
+	// partially, so that the others can be matched against them.
+	candidates := files
+	if unknown > 0 && size > 2*partialBlockSize {
+		partials := make(map[string][]*db.FileEntry)
+		for _, e := range files {
+			path, err := getPath(e.Id)
+			if err != nil {
+				log.Dbg.Printf("FileIndexer: cannot get path of %x: %s", e.Id, err.Error())
+				continue
+			}
+			p, err := partialChecksum(path, size)
+			if err != nil {
+				log.Dbg.Printf("FileIndexer: cannot read '%s': %s", path, err.Error())
+				continue
+			}
+			atomic.AddUint64(&s.stats.NFiles, 1)
+			atomic.AddUint64(&s.stats.TotalSize, 2*partialBlockSize)
+			partials[p] = append(partials[p], e)
+		}
+		candidates = []*db.FileEntry{}
+		for _, p := range partials {
+			if len(p) > 1 {
+				candidates = append(candidates, p...)
+			}
+		}
+	}
+
+	// full checksums
+	h, _ := hash.NewContentHash(algo)
+	buf := make([]byte, checksumBufferSize)
+	limiter := newRateLimiter(0)
+	full := make(map[string][]int64)
+	for _, e := range candidates {
+		if e.Checksum == "" {
+			path, err := getPath(e.Id)
+			if err != nil {
+				log.Dbg.Printf("FileIndexer: cannot get path of %x: %s", e.Id, err.Error())
+				continue
+			}
+			sum, n, err := checksumFile(path, h, buf, limiter)
+			if err != nil {
+				log.Dbg.Printf("FileIndexer: cannot checksum '%s': %s", path, err.Error())
+				continue
+			}
+			atomic.AddUint64(&s.stats.NFiles, 1)
+			atomic.AddUint64(&s.stats.TotalSize, uint64(n))
+			e.Checksum = sum
+			cchecksums <- db.Checksum{Id: e.Id, Checksum: sum}
+		}
+		full[e.Checksum] = append(full[e.Checksum], e.Id)
+	}
+	for sum, ids := range full {
+		if len(ids) > 1 {
+			csets <- db.DuplicateSet{Size: size, Checksum: sum, Ids: ids}
+		}
+	}
+}
+
+// Hash of the first and last blocks of a file
+func partialChecksum(path string, size int64) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h, _ := hash.NewContentHash("xxh64")
+	buf := make([]byte, partialBlockSize)
+	for _, offset := range []int64{0, size - partialBlockSize} {
+		_, err = f.ReadAt(buf, offset)
+		if err != nil {
+			return "", err
+		}
+		h.Write(buf)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
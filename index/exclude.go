@@ -0,0 +1,187 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Scanning options. Exclude and Include are gitignore-style patterns relative
+// to the root, Include patterns taking precedence. Ignore files with a name in
+// IgnoreFiles are read in each directory and apply to its subtree. With
+// OneFileSystem directories on other devices are not scanned, and directories
+// at depth MaxDepth are not scanned if MaxDepth is non-negative. With
+// FollowSymlinks symbolic links are indexed as their target, directory loops
+// being detected from device and inode numbers. Directories are scanned in
+// breadth-first order, or depth-first with DepthFirst which keeps the queue of
+// pending directories smaller on wide trees.
+type ScanOpt struct {
+	Exclude        []string
+	Include        []string
+	IgnoreFiles    []string
+	OneFileSystem  bool
+	MaxDepth       int
+	FollowSymlinks bool
+	DepthFirst     bool
+}
+
+type ignoreRule struct {
+	base     string
+	segments []string
+	anchored bool
+	dirOnly  bool
+	negate   bool
+}
+
+// Chain of ignore rules from a directory up to the root
+type ignoreList struct {
+	parent *ignoreList
+	rules  []ignoreRule
+}
+
+// Parse a gitignore-style pattern relative to the directory base, return false
+// for blank lines and comments.
+func parseIgnoreRule(base string, pattern string) (ignoreRule, bool) {
+	r := ignoreRule{base: base}
+	pattern = strings.TrimRight(pattern, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return r, false
+	}
+	if strings.HasPrefix(pattern, "!") {
+		r.negate = true
+		pattern = pattern[1:]
+	} else if strings.HasPrefix(pattern, "\\") {
+		pattern = pattern[1:]
+	}
+	if strings.HasSuffix(pattern, "/") {
+		r.dirOnly = true
+		pattern = strings.TrimRight(pattern, "/")
+	}
+	r.anchored = strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+	if pattern == "" {
+		return r, false
+	}
+	r.segments = strings.Split(pattern, "/")
+	return r, true
+}
+
+func matchSegments(pattern []string, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	ok, err := filepath.Match(pattern[0], path[0])
+	return err == nil && ok && matchSegments(pattern[1:], path[1:])
+}
+
+// Match a root-relative path against the rule
+func (r *ignoreRule) match(relPath string, isDir bool) bool {
+	if r.dirOnly && !isDir {
+		return false
+	}
+	if r.base != "" {
+		if !strings.HasPrefix(relPath, r.base+"/") {
+			return false
+		}
+		relPath = relPath[len(r.base)+1:]
+	}
+	if !r.anchored {
+		return matchSegments(r.segments, []string{filepath.Base(relPath)})
+	}
+	return matchSegments(r.segments, strings.Split(relPath, "/"))
+}
+
+// Return whether the rules decide on the path, and if they ignore it. The last
+// matching rule of the deepest list wins.
+func (l *ignoreList) ignored(relPath string, isDir bool) (bool, bool) {
+	for ; l != nil; l = l.parent {
+		for i := len(l.rules) - 1; i >= 0; i-- {
+			if l.rules[i].match(relPath, isDir) {
+				return true, !l.rules[i].negate
+			}
+		}
+	}
+	return false, false
+}
+
+// Rule list from the command line options
+func newOptionIgnoreList(opt ScanOpt) *ignoreList {
+	l := &ignoreList{}
+	for _, p := range opt.Exclude {
+		if r, ok := parseIgnoreRule("", p); ok {
+			l.rules = append(l.rules, r)
+		}
+	}
+	for _, p := range opt.Include {
+		if r, ok := parseIgnoreRule("", "!"+strings.TrimPrefix(p, "!")); ok {
+			l.rules = append(l.rules, r)
+		}
+	}
+	return l
+}
+
+// Extend the parent list with the ignore files present in the directory dir,
+// with root-relative path relPath.
+func readIgnoreFiles(parent *ignoreList, dir string, relPath string, names []string) *ignoreList {
+	l := &ignoreList{parent: parent}
+	for _, name := range names {
+		f, err := os.Open(filepath.Join(dir, name))
+		if err != nil {
+			continue
+		}
+		sc := bufio.NewScanner(f)
+		for sc.Scan() {
+			if r, ok := parseIgnoreRule(relPath, sc.Text()); ok {
+				l.rules = append(l.rules, r)
+			}
+		}
+		f.Close()
+	}
+	if len(l.rules) == 0 {
+		return parent
+	}
+	return l
+}
+
+// Return whether an entry must be skipped
+func (s *FileIndexer) isExcluded(ignore *ignoreList, relPath string, isDir bool) bool {
+	if decided, ignored := s.optionRules.ignored(relPath, isDir); decided {
+		return ignored
+	}
+	_, ignored := ignore.ignored(relPath, isDir)
+	return ignored
+}
+
+func (s *FileIndexer) addExcluded(relPath string) {
+	s.excludedMutex.Lock()
+	s.excluded = append(s.excluded, relPath)
+	s.excludedMutex.Unlock()
+}
@@ -0,0 +1,46 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package hash
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	gohash "hash"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Supported file content digest algorithms
+var ContentAlgorithms = []string{"sha256", "sha1", "md5", "xxh64"}
+
+// Return a new file content digest for the given algorithm
+func NewContentHash(algo string) (gohash.Hash, error) {
+	switch algo {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "md5":
+		return md5.New(), nil
+	case "xxh64":
+		return xxhash.New(), nil
+	default:
+		return nil, fmt.Errorf("unknown checksum algorithm '%s'", algo)
+	}
+}
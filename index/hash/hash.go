@@ -19,7 +19,6 @@ package hash
 import (
 	"crypto/md5"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
 	"path/filepath"
 
@@ -40,8 +39,11 @@ func Md548(s string) int64 {
 	return hash
 }
 
+// Path hashing with the legacy 48 bit MD5 scheme
+var legacy = PathHasher{md548Hasher{}}
+
 func StepHash(parentHash int64, s string) int64 {
-	return Md548(HashToString(parentHash) + s)
+	return legacy.StepHash(parentHash, s)
 }
 
 func normalisePath(path string) (string, error) {
@@ -53,38 +55,15 @@ func normalisePath(path string) (string, error) {
 }
 
 func PathHash(path string) (int64, error) {
-	normPath, err := normalisePath(path)
-	if err != nil {
-		return -1, err
-	}
-	dir := filepath.Dir(normPath)
-	name := filepath.Base(normPath)
-	if dir != "." {
-		dirHash, err := PathHash(dir)
-		if err != nil {
-			return -1, err
-		}
-		return StepHash(dirHash, name), nil
-	} else {
-		return Md548(name), nil
-	}
+	return legacy.PathHash(path)
 }
 
 // Convert a path hash to an hexadecimal string
 func HashToString(hash int64) string {
-	byteHash := make([]byte, 8)
-	binary.BigEndian.PutUint64(byteHash, (uint64)(hash))
-	byteHash = byteHash[2:]
-	return fmt.Sprintf("%012x", byteHash)
+	return legacy.HashToString(hash)
 }
 
 // Convert a path hash hexadecimal string to int64
 func StringToHash(hash string) (int64, error) {
-	byteHash, err := hex.DecodeString(hash)
-	if err != nil {
-		return -1, err
-	}
-	byteHash = append([]byte{0, 0}, byteHash...)
-	intHash := int64(binary.BigEndian.Uint64(byteHash))
-	return intHash, nil
+	return legacy.StringToHash(hash)
 }
@@ -0,0 +1,149 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package hash
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/cespare/xxhash/v2"
+)
+
+// Path id scheme, hashes are non-negative int64 (SQLite does not support
+// uint64) written with Digits hexadecimal digits in the index paths. The name
+// and version of the scheme are stored in the index database, the version must
+// change whenever the hashes do.
+type Hasher interface {
+	Name() string
+	Version() int
+	Digits() int
+	Hash(s string) int64
+}
+
+// Legacy 48 bit MD5 scheme, see Md548
+type md548Hasher struct{}
+
+func (md548Hasher) Name() string        { return "md5-48" }
+func (md548Hasher) Version() int        { return 1 }
+func (md548Hasher) Digits() int         { return 12 }
+func (md548Hasher) Hash(s string) int64 { return Md548(s) }
+
+// 63 bit xxHash scheme, the highest bit of the 64 bit hash being dropped
+type xxh63Hasher struct{}
+
+func (xxh63Hasher) Name() string        { return "xxh64" }
+func (xxh63Hasher) Version() int        { return 1 }
+func (xxh63Hasher) Digits() int         { return 16 }
+func (xxh63Hasher) Hash(s string) int64 { return int64(xxhash.Sum64String(s) >> 1) }
+
+const DefaultHasher = "md5-48"
+
+var hashers = map[string]Hasher{}
+
+func init() {
+	RegisterHasher(md548Hasher{})
+	RegisterHasher(xxh63Hasher{})
+}
+
+// Make a hasher available by name, replacing any hasher with the same name
+func RegisterHasher(h Hasher) {
+	hashers[h.Name()] = h
+}
+
+// Sorted names of the available hashers
+func HasherNames() []string {
+	names := make([]string, 0, len(hashers))
+	for name := range hashers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Path hashing with a given scheme
+type PathHasher struct {
+	Hasher
+}
+
+func NewPathHasher(name string) (PathHasher, error) {
+	h, ok := hashers[name]
+	if !ok {
+		return PathHasher{}, fmt.Errorf("unknown hash scheme '%s'", name)
+	}
+	return PathHasher{h}, nil
+}
+
+func (p PathHasher) StepHash(parentHash int64, s string) int64 {
+	return p.Hash(p.HashToString(parentHash) + s)
+}
+
+// Hash of a path relative to the index root, the hash of a directory entry
+// being the hash of its name appended to the hash string of its parent.
+func (p PathHasher) PathHash(path string) (int64, error) {
+	normPath, err := normalisePath(path)
+	if err != nil {
+		return -1, err
+	}
+	dir := filepath.Dir(normPath)
+	name := filepath.Base(normPath)
+	if dir != "." {
+		dirHash, err := p.PathHash(dir)
+		if err != nil {
+			return -1, err
+		}
+		return p.StepHash(dirHash, name), nil
+	} else {
+		return p.Hash(name), nil
+	}
+}
+
+// Hash of a path relative to an index root in the id namespace of the root.
+// Paths are hashed with PathHash in the empty namespace, and otherwise as if
+// they were in a directory named "\x00<namespace>", which no file can be
+// named, so that each namespace has its own ids.
+func (p PathHasher) RootPathHash(namespace string, path string) (int64, error) {
+	if namespace == "" {
+		return p.PathHash(path)
+	}
+	normPath, err := normalisePath(path)
+	if err != nil {
+		return -1, err
+	}
+	if normPath == "." {
+		return p.Hash("\x00" + namespace), nil
+	}
+	dirHash, err := p.RootPathHash(namespace, filepath.Dir(normPath))
+	if err != nil {
+		return -1, err
+	}
+	return p.StepHash(dirHash, filepath.Base(normPath)), nil
+}
+
+// Convert a path hash to an hexadecimal string
+func (p PathHasher) HashToString(hash int64) string {
+	return fmt.Sprintf("%0*x", p.Digits(), uint64(hash))
+}
+
+// Convert a path hash hexadecimal string to int64
+func (p PathHasher) StringToHash(hash string) (int64, error) {
+	if len(hash) != p.Digits() {
+		return -1, fmt.Errorf("hash string '%s' does not have %d digits", hash, p.Digits())
+	}
+	return strconv.ParseInt(hash, 16, 64)
+}
@@ -17,40 +17,98 @@ along with this program. If not, see <http://www.gnu.org/licenses/>.
 package index
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io/fs"
 	"os"
 	"path/filepath"
 	"sync"
 	"sync/atomic"
+	"syscall"
 
 	log "github.com/aportelli/golog"
 	"github.com/aportelli/hyperspace/index/db"
-	"github.com/aportelli/hyperspace/index/hash"
+	"golang.org/x/text/unicode/norm"
 )
 
-type InterruptError struct{}
+// Error returned by a scan stopped before completion by Interrupt or by the
+// end of its context, Err is the context error if any. The entries scanned so
+// far are kept in the index, whose latest snapshot is left incomplete.
+type InterruptError struct {
+	Err   error
+	Stats IndexerStats
+}
 
 func (e *InterruptError) Error() string {
+	if e.Err != nil {
+		return "indexing interrupted: " + e.Err.Error()
+	}
 	return "indexing interrupted"
 }
 
+func (e *InterruptError) Unwrap() error {
+	return e.Err
+}
+
+// Returned by the directory walk function when the scan is cancelled
+var errScanCancelled = errors.New("scan cancelled")
+
+// Number of entries sent to the inserter at once
+const entryBatchSize = 256
+
 type scanChan struct {
-	entries chan<- *db.FileEntry
-	errors  chan<- error
-	guard   chan struct{}
+	entries    chan<- db.EntryBatch
+	scanErrors chan<- *db.ScanError
+	errors     chan<- error
+	done       <-chan struct{}
 }
 
+// Send entries to the inserter, returning false if the scan was cancelled
+func (c scanChan) sendBatch(b db.EntryBatch) bool {
+	select {
+	case c.entries <- b:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// Directory to scan, Id and HashPath are the nominal id and id path of its
+// entry, the inserter sets the resolved ones in Entry
 type dirData struct {
-	Path     string
-	TreePath string
-	HashPath string
-	Depth    uint
-	Id       int64
+	Path      string
+	TreePath  string
+	HashPath  string
+	Depth     uint
+	Id        int64
+	Entry     *db.FileEntry
+	Ignore    *ignoreList
+	Ancestors []devIno
+}
+
+// Device and inode numbers identifying a file
+type devIno struct {
+	Dev   int64
+	Inode int64
 }
 
 func (s *FileIndexer) IndexDir(dir string) error {
-	var status int
+	return s.IndexDirContext(context.Background(), dir)
+}
+
+// Index the directory dir, stopping when ctx is done. Errors stop the scan and
+// are returned once all workers have exited, a scan stopped by ctx or
+// Interrupt returns an InterruptError. The directories left to scan by a
+// stopped scan are saved in the index, and scanned by the next call if Resume
+// is set. The directory is added to the roots of the index if needed, and an
+// update leaves the entries of the other roots untouched.
+func (s *FileIndexer) IndexDirContext(ctx context.Context, dir string) error {
 	s.resetStats()
+	s.optionRules = newOptionIgnoreList(s.ScanOpt)
+	s.excluded = nil
+	s.unfinished = nil
+	s.inodes = make(map[devIno]struct{})
 	info, err := os.Stat(dir)
 	if err != nil {
 		return err
@@ -59,68 +117,158 @@ func (s *FileIndexer) IndexDir(dir string) error {
 	if err != nil {
 		return err
 	}
-	s.Db.SetValue("root_input", dir)
-	s.Db.SetValue("root_abs", root)
-	centries := make(chan *db.FileEntry)
+	queue := newDirQueue(s.ScanOpt.DepthFirst, &s.stats.QueuedDirs)
+	if s.Resume {
+		err = s.resumeScan(dir, root, queue)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = s.Db.SetRoot(root, dir)
+		if err != nil {
+			return err
+		}
+		err = s.Db.BeginSnapshot(root)
+		if err != nil {
+			return err
+		}
+		err = s.Db.ClearScanErrors()
+		if err != nil {
+			return err
+		}
+		err = s.Db.InitCheckpoint()
+		if err != nil {
+			return err
+		}
+	}
+	id, err := s.Db.RootPathHash("")
+	if err != nil {
+		return err
+	}
+	rootEntry := &db.FileEntry{
+		Id:       id,
+		ParentId: nil,
+		Path:     "",
+		Depth:    0,
+		Name:     "",
+		Type:     "d",
+		Size:     info.Size(),
+		Mtime:    info.ModTime().UnixNano(),
+	}
+	setStat(rootEntry, info)
+	s.rootDev = rootEntry.Dev
+	ctx = s.startScan(ctx)
+	defer s.endScan()
+	centries := make(chan db.EntryBatch, s.NumWorkers)
+	cscanErrors := make(chan *db.ScanError)
 	cerrors := make(chan error)
 	cquit := make(chan struct{})
-	cguard := make(chan struct{}, s.NumWorkers)
-	quitScan := make(chan int)
-	s.quitScan = quitScan
-	sc := scanChan{entries: centries, errors: cerrors, guard: cguard}
-	ic := db.InsertChan{Entries: centries, Quit: cquit, Errors: cerrors}
-	var swg sync.WaitGroup
+	sc := scanChan{entries: centries, scanErrors: cscanErrors, errors: cerrors, done: ctx.Done()}
+	ic := db.InsertChan{Entries: centries, ScanErrors: cscanErrors, Quit: cquit, Errors: cerrors}
+
+	// the first error cancels the scan, later ones are only drained
+	var scanErr error
+	errorsDone := make(chan struct{})
+	go func() {
+		for err := range cerrors {
+			if scanErr == nil {
+				scanErr = err
+				s.Interrupt()
+			}
+		}
+		close(errorsDone)
+	}()
 	s.indexWg.Add(1)
 	go s.Db.InsertData(ic, &s.indexWg)
-	go func() {
-		log.Dbg.Printf("FileIndexer: Scanner starting")
-		id, err := hash.PathHash("")
-		if err != nil {
-			cerrors <- err
-		}
-		centries <- &db.FileEntry{
-			Id:       id,
-			ParentId: nil,
-			Path:     "",
-			Depth:    0,
-			Name:     "",
-			Type:     "d",
-			Size:     info.Size(),
+
+	// scan
+	log.Dbg.Printf("FileIndexer: Scanner starting")
+	var swg sync.WaitGroup
+	if !s.Resume {
+		b := db.EntryBatch{Entries: []*db.FileEntry{rootEntry}}
+		if s.ScanOpt.MaxDepth != 0 {
+			rootDir := dirData{Path: dir, TreePath: "", HashPath: "", Depth: 1, Id: id, Entry: rootEntry}
+			if s.ScanOpt.FollowSymlinks {
+				rootDir.Ancestors = []devIno{{Dev: rootEntry.Dev, Inode: rootEntry.Inode}}
+			}
+			queue.push(rootDir)
+		} else {
+			b.Done = []*db.FileEntry{rootEntry}
 		}
-		swg.Add(1)
-		cguard <- struct{}{}
-		go s.scanDirectory(dirData{Path: dir, TreePath: "", HashPath: "", Id: id}, sc, &swg)
-		swg.Wait()
-		quitScan <- 0
+		// the inserter is running, and the root must be inserted for the scan
+		// to be resumable
+		centries <- b
+	}
+	go func() {
+		<-ctx.Done()
+		queue.close()
 	}()
-out:
-	for {
-		select {
-		case status = <-quitScan:
-			close(cquit)
-			s.quitScan = nil
-			break out
-		case err := <-cerrors:
-			close(cquit)
-			s.quitScan = nil
+	for i := uint(0); i < s.NumWorkers || i == 0; i++ {
+		swg.Add(1)
+		go s.scanWorker(queue, sc, &swg)
+	}
+	swg.Wait()
+	close(cquit)
+	s.indexWg.Wait()
+	close(cerrors)
+	<-errorsDone
+	ctxErr := ctx.Err()
+	s.endScan()
+
+	// bookkeeping
+	err = s.Db.SetRootScan(s.excluded, s.ScanOpt.MaxDepth)
+	if err != nil {
+		return err
+	}
+	if scanErr != nil || ctxErr != nil {
+		err = s.saveCheckpoint(queue)
+		if err != nil {
 			return err
 		}
+		if scanErr != nil {
+			return scanErr
+		}
+		return &InterruptError{Err: ctxErr, Stats: s.Stats()}
 	}
-	s.indexWg.Wait()
-	if status == 1 {
-		return &InterruptError{}
-	} else {
-		return nil
+	err = s.Db.ClearCheckpoint()
+	if err != nil {
+		return err
 	}
+	if s.Db.Update {
+		err = s.Db.DeleteUnseen()
+		if err != nil {
+			return err
+		}
+		err = s.Db.EndUpdate()
+		if err != nil {
+			return err
+		}
+	}
+	return s.Db.EndSnapshot()
 }
 
-func (s *FileIndexer) scanDirectory(dd dirData, c scanChan, wg *sync.WaitGroup) {
+// Scan the directories of the queue until it is empty or closed
+func (s *FileIndexer) scanWorker(q *dirQueue, c scanChan, wg *sync.WaitGroup) {
 	defer wg.Done()
-	defer func() { <-c.guard }()
-
-	// registering as active
-	atomic.AddInt32(&s.stats.ActiveWorkers, 1)
+	for {
+		dd, ok := q.pop()
+		if !ok {
+			return
+		}
+		atomic.AddInt32(&s.stats.ActiveWorkers, 1)
+		if !s.scanDirectory(dd, c, q) {
+			s.unfinishedMutex.Lock()
+			s.unfinished = append(s.unfinished, dd)
+			s.unfinishedMutex.Unlock()
+		}
+		atomic.AddInt32(&s.stats.ActiveWorkers, -1)
+		q.done()
+	}
+}
 
+// Scan the entries of a directory and queue its subdirectories, returning
+// false if the scan of the directory did not complete
+func (s *FileIndexer) scanDirectory(dd dirData, c scanChan, q *dirQueue) bool {
 	// path append function
 	pathAppend := func(path string, extra string) string {
 		if path != "" {
@@ -130,76 +278,209 @@ func (s *FileIndexer) scanDirectory(dd dirData, c scanChan, wg *sync.WaitGroup)
 		}
 	}
 
+	// ignore files
+	ignore := readIgnoreFiles(dd.Ignore, dd.Path, dd.TreePath, s.ScanOpt.IgnoreFiles)
+
+	// entries are sent in batches, and subdirectories are only queued once
+	// their entries are sent so that parents reach the inserter first. The
+	// directory and its subdirectories which are not scanned are finished with
+	// the last batch.
+	var batch []*db.FileEntry
+	var subdirs []dirData
+	done := []*db.FileEntry{dd.Entry}
+
 	// scan function
 	scan := func(path string, d os.DirEntry, err error) error {
+		select {
+		case <-c.done:
+			return errScanCancelled
+		default:
+		}
 		if err != nil {
+			if path == dd.Path {
+				op := "readdir"
+				if d == nil {
+					op = "lstat"
+				}
+				s.reportError(c, dd.TreePath, op, err)
+			} else {
+				s.reportError(c, pathAppend(dd.TreePath, filepath.Base(path)), "lstat", err)
+			}
+			return nil
+		}
+		if dd.Path != path && s.isExcluded(ignore, pathAppend(dd.TreePath, d.Name()), d.IsDir()) {
+			if d.IsDir() {
+				s.addExcluded(pathAppend(dd.TreePath, d.Name()))
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if dd.Path == path {
 			return nil
 		}
+		skip := error(nil)
+		if d.IsDir() {
+			skip = filepath.SkipDir
+		}
+		treePath := pathAppend(dd.TreePath, d.Name())
 		info, err2 := d.Info()
 		if err2 != nil {
-			return nil
+			s.reportError(c, treePath, "lstat", err2)
+			return skip
+		}
+		newId, err2 := s.Db.RootPathHash(treePath)
+		if err2 != nil {
+			return err2
 		}
-		if d.IsDir() && dd.Path != path {
-			newTreePath := pathAppend(dd.TreePath, info.Name())
-			newId, err2 := hash.PathHash(newTreePath)
+		hashPath := pathAppend(dd.HashPath, s.Db.Hasher.HashToString(newId))
+		var target string
+		var dangling, followed bool
+		if info.Mode()&fs.ModeSymlink != 0 {
+			target, err2 = os.Readlink(path)
 			if err2 != nil {
-				return err2
+				s.reportError(c, treePath, "readlink", err2)
 			}
-			newHashPath := pathAppend(dd.HashPath, hash.HashToString(newId))
-			c.entries <- &db.FileEntry{
-				Id:       newId,
-				ParentId: dd.Id,
-				Path:     newHashPath,
-				Depth:    dd.Depth,
-				Name:     info.Name(),
-				Type:     "d",
-				Size:     info.Size(),
-			}
-			atomic.AddUint64(&s.stats.NFiles, 1)
-			atomic.AddUint64(&s.stats.TotalSize, uint64(info.Size()))
-			wg.Add(1)
-			go func() {
-				atomic.AddInt32(&s.stats.QueuingWorkers, 1)
-				c.guard <- struct{}{}
-				atomic.AddInt32(&s.stats.QueuingWorkers, -1)
-				s.scanDirectory(dirData{
-					Path:     path,
-					TreePath: newTreePath,
-					HashPath: newHashPath,
-					Depth:    dd.Depth + 1,
-					Id:       newId,
-				}, c, wg)
-			}()
-			return filepath.SkipDir
-		} else if !d.IsDir() {
-			treePath := pathAppend(dd.TreePath, info.Name())
-			newId, err2 := hash.PathHash(treePath)
+			targetInfo, err2 := os.Stat(path)
 			if err2 != nil {
-				return err2
+				dangling = true
+			} else if s.ScanOpt.FollowSymlinks {
+				info = targetInfo
+				followed = true
 			}
-			hashPath := pathAppend(dd.HashPath, hash.HashToString(newId))
-			c.entries <- &db.FileEntry{
-				Id:       newId,
-				ParentId: dd.Id,
-				Path:     hashPath,
-				Depth:    dd.Depth,
-				Name:     info.Name(),
-				Type:     "f",
-				Size:     info.Size(),
+		}
+		entry := &db.FileEntry{
+			Id:       newId,
+			ParentId: dd.Id,
+			Path:     hashPath,
+			Depth:    dd.Depth,
+			Name:     norm.NFC.String(info.Name()),
+			Type:     fileType(info.Mode()),
+			Size:     info.Size(),
+			Mtime:    info.ModTime().UnixNano(),
+			Target:   target,
+			Dangling: dangling,
+			Parent:   dd.Entry,
+		}
+		setStat(entry, info)
+		if !info.IsDir() && entry.Nlink > 1 {
+			entry.Secondary = s.seenInode(entry)
+		}
+		batch = append(batch, entry)
+		if len(batch) == entryBatchSize {
+			if !c.sendBatch(db.EntryBatch{Entries: batch}) {
+				return errScanCancelled
 			}
-			atomic.AddUint64(&s.stats.NFiles, 1)
+			batch = nil
+		}
+		atomic.AddUint64(&s.stats.NFiles, 1)
+		if !entry.Secondary {
 			atomic.AddUint64(&s.stats.TotalSize, uint64(info.Size()))
+		}
+		if !info.IsDir() {
 			return nil
 		}
-		return nil
+		if s.ScanOpt.OneFileSystem && entry.Dev != s.rootDev {
+			s.addExcluded(treePath)
+			done = append(done, entry)
+			return skip
+		}
+		if s.ScanOpt.MaxDepth >= 0 && int(dd.Depth) >= s.ScanOpt.MaxDepth {
+			done = append(done, entry)
+			return skip
+		}
+		var ancestors []devIno
+		if s.ScanOpt.FollowSymlinks {
+			key := devIno{Dev: entry.Dev, Inode: entry.Inode}
+			for _, a := range dd.Ancestors {
+				if a == key {
+					s.reportError(c, treePath, "follow", errors.New("file system loop"))
+					done = append(done, entry)
+					return skip
+				}
+			}
+			ancestors = append(append(make([]devIno, 0, len(dd.Ancestors)+1), dd.Ancestors...), key)
+		}
+		if followed {
+			path += string(filepath.Separator)
+		}
+		subdirs = append(subdirs, dirData{
+			Path:      path,
+			TreePath:  treePath,
+			HashPath:  hashPath,
+			Depth:     dd.Depth + 1,
+			Id:        newId,
+			Entry:     entry,
+			Ignore:    ignore,
+			Ancestors: ancestors,
+		})
+		return skip
 	}
 
 	// walk the tree
 	err := filepath.WalkDir(dd.Path, scan)
-	if err != nil {
+	if err == errScanCancelled {
+		return false
+	} else if err != nil {
 		c.errors <- err
+		return false
+	}
+	if !c.sendBatch(db.EntryBatch{Entries: batch, Done: done}) {
+		return false
+	}
+	for _, sub := range subdirs {
+		q.push(sub)
+	}
+	return true
+}
+
+// Record a non-fatal scanning error on the entry with root-relative path
+// relPath
+func (s *FileIndexer) reportError(c scanChan, relPath string, op string, err error) {
+	var errno syscall.Errno
+	e := &db.ScanError{Path: relPath, Operation: op, Message: err.Error()}
+	if errors.As(err, &errno) {
+		e.Errno = int(errno)
+	}
+	atomic.AddUint64(&s.stats.NErrors, 1)
+	log.Dbg.Printf("FileIndexer: %s '%s': %s", op, relPath, e.Message)
+	select {
+	case c.scanErrors <- e:
+	case <-c.done:
 	}
+}
 
-	// registering as inactive
-	atomic.AddInt32(&s.stats.ActiveWorkers, -1)
+// Return whether a hard link to the same file was already scanned
+func (s *FileIndexer) seenInode(e *db.FileEntry) bool {
+	key := devIno{Dev: e.Dev, Inode: e.Inode}
+	s.inodesMutex.Lock()
+	defer s.inodesMutex.Unlock()
+	_, ok := s.inodes[key]
+	if !ok {
+		s.inodes[key] = struct{}{}
+	}
+	return ok
+}
+
+// Entry type code: d (directory), f (regular file), l (symbolic link),
+// p (named pipe), s (socket), b (block device), c (character device) or ?
+// (other)
+func fileType(mode fs.FileMode) string {
+	switch {
+	case mode.IsDir():
+		return "d"
+	case mode.IsRegular():
+		return "f"
+	case mode&fs.ModeSymlink != 0:
+		return "l"
+	case mode&fs.ModeNamedPipe != 0:
+		return "p"
+	case mode&fs.ModeSocket != 0:
+		return "s"
+	case mode&fs.ModeCharDevice != 0:
+		return "c"
+	case mode&fs.ModeDevice != 0:
+		return "b"
+	default:
+		return "?"
+	}
 }
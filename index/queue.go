@@ -0,0 +1,118 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Queue of directories waiting to be scanned, shared by the scanning workers.
+// Directories are popped in insertion order (breadth-first scan) or in reverse
+// insertion order (depth-first scan). A pop blocks until a directory is
+// available and returns false once the queue is closed or all directories have
+// been scanned. The number of queued directories is published in queued.
+type dirQueue struct {
+	dirs       []dirData
+	head       int
+	active     int
+	depthFirst bool
+	closed     bool
+	queued     *int32
+	mutex      sync.Mutex
+	cond       *sync.Cond
+}
+
+func newDirQueue(depthFirst bool, queued *int32) *dirQueue {
+	q := &dirQueue{depthFirst: depthFirst, queued: queued}
+	q.cond = sync.NewCond(&q.mutex)
+	return q
+}
+
+func (q *dirQueue) len() int {
+	return len(q.dirs) - q.head
+}
+
+func (q *dirQueue) push(dd dirData) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.dirs = append(q.dirs, dd)
+	atomic.StoreInt32(q.queued, int32(q.len()))
+	q.cond.Signal()
+}
+
+// Pop the next directory, the caller must call done once it is scanned
+func (q *dirQueue) pop() (dirData, bool) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for !q.closed && q.len() == 0 && q.active > 0 {
+		q.cond.Wait()
+	}
+	if q.closed || q.len() == 0 {
+		return dirData{}, false
+	}
+	var dd dirData
+	if q.depthFirst {
+		dd = q.dirs[len(q.dirs)-1]
+		q.dirs[len(q.dirs)-1] = dirData{}
+		q.dirs = q.dirs[:len(q.dirs)-1]
+	} else {
+		dd = q.dirs[q.head]
+		q.dirs[q.head] = dirData{}
+		q.head++
+		// reclaim the popped part once it dominates the slice
+		if q.head > 1024 && 2*q.head > len(q.dirs) {
+			q.dirs = append(make([]dirData, 0, 2*q.len()), q.dirs[q.head:]...)
+			q.head = 0
+		}
+	}
+	if q.len() == 0 {
+		q.dirs = q.dirs[:0]
+		q.head = 0
+	}
+	atomic.StoreInt32(q.queued, int32(q.len()))
+	q.active++
+	return dd, true
+}
+
+func (q *dirQueue) done() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.active--
+	if q.active == 0 && q.len() == 0 {
+		q.cond.Broadcast()
+	}
+}
+
+// Wake up all waiting workers and make them exit
+func (q *dirQueue) close() {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	q.closed = true
+	q.cond.Broadcast()
+}
+
+// Remove and return the queued directories
+func (q *dirQueue) drain() []dirData {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	dirs := append([]dirData(nil), q.dirs[q.head:]...)
+	q.dirs = nil
+	q.head = 0
+	atomic.StoreInt32(q.queued, 0)
+	return dirs
+}
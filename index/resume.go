@@ -0,0 +1,127 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+// Save the directories left to scan, queued or unfinished, in the checkpoint
+// of the index. This must be called once the inserter has returned, the ids of
+// the directory entries are then resolved.
+func (s *FileIndexer) saveCheckpoint(q *dirQueue) error {
+	dirs := append(q.drain(), s.unfinished...)
+	checkpoint := make([]db.CheckpointDir, 0, len(dirs))
+	for _, dd := range dirs {
+		checkpoint = append(checkpoint, db.CheckpointDir{Id: dd.Entry.Id, Path: dd.TreePath,
+			HashPath: dd.Entry.Path, Depth: dd.Depth})
+	}
+	return s.Db.SaveCheckpoint(checkpoint)
+}
+
+// Queue the directories left to scan by an interrupted scan of root, whose
+// absolute path is rootAbs. The entries already inserted for an unfinished
+// directory are removed when rebuilding an index, and updated again otherwise.
+func (s *FileIndexer) resumeScan(root string, rootAbs string, q *dirQueue) error {
+	dirs, err := s.Db.LoadCheckpoint(rootAbs)
+	if err != nil {
+		return err
+	}
+	r, _, err := s.Db.FindRoot(rootAbs)
+	if err != nil {
+		return err
+	}
+	s.excluded = r.Excluded
+	ignores := make(map[string]*ignoreList)
+	for _, dir := range dirs {
+		if !s.Db.Update {
+			err = s.Db.DeleteChildren(dir.Id)
+			if err != nil {
+				return err
+			}
+		}
+		dd := dirData{
+			Path:     filepath.Join(root, dir.Path),
+			TreePath: dir.Path,
+			HashPath: dir.HashPath,
+			Depth:    dir.Depth,
+			Id:       dir.Id,
+			Entry:    &db.FileEntry{Id: dir.Id, Path: dir.HashPath},
+		}
+		if dir.Path != "" {
+			dd.Ignore = s.ignoreChain(root, parentPath(dir.Path), ignores)
+		}
+		if s.ScanOpt.FollowSymlinks {
+			dd.Path += string(filepath.Separator)
+			dd.Ancestors = ancestorInodes(root, dir.Path)
+		}
+		q.push(dd)
+	}
+	return nil
+}
+
+// Parent of a root-relative path, "" for the root children
+func parentPath(relPath string) string {
+	i := strings.LastIndex(relPath, "/")
+	if i < 0 {
+		return ""
+	}
+	return relPath[:i]
+}
+
+// Ignore rules applying to the children of the directory relPath, read from
+// the ignore files of the directory and its ancestors
+func (s *FileIndexer) ignoreChain(root string, relPath string, cache map[string]*ignoreList) *ignoreList {
+	if l, ok := cache[relPath]; ok {
+		return l
+	}
+	var parent *ignoreList
+	if relPath != "" {
+		parent = s.ignoreChain(root, parentPath(relPath), cache)
+	}
+	l := readIgnoreFiles(parent, filepath.Join(root, relPath), relPath, s.ScanOpt.IgnoreFiles)
+	cache[relPath] = l
+	return l
+}
+
+// Device and inode numbers of the directory relPath and its ancestors, symbolic
+// links being followed
+func ancestorInodes(root string, relPath string) []devIno {
+	var ancestors []devIno
+	path := root
+	components := []string{}
+	if relPath != "" {
+		components = strings.Split(relPath, "/")
+	}
+	for i := 0; i <= len(components); i++ {
+		if i > 0 {
+			path = filepath.Join(path, components[i-1])
+		}
+		info, err := os.Stat(path)
+		if err != nil {
+			break
+		}
+		e := new(db.FileEntry)
+		setStat(e, info)
+		ancestors = append(ancestors, devIno{Dev: e.Dev, Inode: e.Inode})
+	}
+	return ancestors
+}
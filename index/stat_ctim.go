@@ -0,0 +1,43 @@
+//go:build linux || openbsd
+
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"io/fs"
+	"syscall"
+
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+// Fill the POSIX metadata of an entry from the system stat structure
+func setStat(e *db.FileEntry, info fs.FileInfo) {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		e.Mode = uint32(info.Mode().Perm())
+		return
+	}
+	e.Ctime = st.Ctim.Nano()
+	e.Mode = uint32(st.Mode)
+	e.Uid = st.Uid
+	e.Gid = st.Gid
+	e.Dev = int64(st.Dev)
+	e.Inode = int64(st.Ino)
+	e.Nlink = int64(st.Nlink)
+	e.Blocks = int64(st.Blocks)
+}
@@ -0,0 +1,30 @@
+//go:build !linux && !openbsd && !darwin && !freebsd && !netbsd
+
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"io/fs"
+
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+// Fill the POSIX metadata of an entry, only permissions are available here
+func setStat(e *db.FileEntry, info fs.FileInfo) {
+	e.Mode = uint32(info.Mode().Perm())
+}
@@ -0,0 +1,82 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aportelli/hyperspace/index"
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestIndexDirContext(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "cancel.db")
+	d, err := db.NewIndexDb(dbPath, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer func() { d.Close() }()
+	s := index.NewFileIndexer(d, 4)
+	ctx, cancel := context.WithTimeout(context.Background(), -time.Second)
+	defer cancel()
+	err = s.IndexDirContext(ctx, testRoot)
+	var e *index.InterruptError
+	if !errors.As(err, &e) {
+		t.Fatalf("Got error %v, expected an interruption", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Got error %s, expected a deadline error", err.Error())
+	}
+	snapshots, err := d.GetSnapshots()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if len(snapshots) != 1 || snapshots[0].Complete {
+		t.Errorf("Got %d snapshots, expected a single incomplete one", len(snapshots))
+	}
+
+	// interrupting concurrently with the scan must not block
+	d.Close()
+	d, err = db.NewIndexDb(dbPath, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	s = index.NewFileIndexer(d, 4)
+	done := make(chan error)
+	go func() {
+		done <- s.IndexDir(testRoot)
+	}()
+	s.Interrupt()
+	select {
+	case err = <-done:
+		if err != nil && !errors.As(err, &e) {
+			t.Errorf("Got error %s", err.Error())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatalf("Interrupted scan did not return")
+	}
+
+	// an interruption outside of a scan is ignored
+	s.Interrupt()
+	d2 := indexTestDir(t, filepath.Join(dir, "cancel2.db"), testRoot, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	d2.Close()
+}
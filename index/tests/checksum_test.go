@@ -0,0 +1,115 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index"
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestChecksum(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "checksum_root")
+	os.MkdirAll(filepath.Join(root, "a"), 0750)
+	os.WriteFile(filepath.Join(root, "a/small"), []byte{1, 2, 3, 4, 5}, 0640)
+	os.WriteFile(filepath.Join(root, "large"), make([]byte, 4096), 0640)
+	d := indexTestDir(t, filepath.Join(dir, "checksum.db"), root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	defer d.Close()
+	s := index.NewFileIndexer(d, 4)
+	err := s.ChecksumFiles(index.ChecksumOpt{Algorithm: "sha256", MaxSize: 1024, Rate: 0})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+
+	tests := []struct {
+		path     string
+		checksum string
+	}{
+		{"a/small", "74f81fe167d99b4cb41d6d0ccda82278caee9f3e2f25d5e5a3936ff3dcec60d0"},
+		{"large", ""},
+	}
+	for _, test := range tests {
+		t.Run("checksum_"+test.path, func(t *testing.T) {
+			id, err := d.GetId(test.path)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			e, err := d.GetEntry(id)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			if e.Checksum != test.checksum {
+				t.Errorf("Got checksum '%s', expected '%s'", e.Checksum, test.checksum)
+			}
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		dir := t.TempDir()
+		root := filepath.Join(dir, "checksum_root")
+		os.MkdirAll(root, 0750)
+		os.WriteFile(filepath.Join(root, "kept"), []byte{1}, 0640)
+		os.WriteFile(filepath.Join(root, "gone"), []byte{2}, 0640)
+		d := indexTestDir(t, filepath.Join(dir, "checksum.db"), root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+		defer d.Close()
+		os.Remove(filepath.Join(root, "gone"))
+		s := index.NewFileIndexer(d, 0)
+		err := s.ChecksumFiles(index.ChecksumOpt{Algorithm: "sha256", MaxSize: -1, Rate: 0})
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		stats := s.Stats()
+		if stats.NFiles != 1 || stats.NErrors != 1 {
+			t.Errorf("Got %d checksum(s) and %d error(s), expected 1 and 1", stats.NFiles, stats.NErrors)
+		}
+	})
+
+	t.Run("links", func(t *testing.T) {
+		dir := t.TempDir()
+		root := filepath.Join(dir, "checksum_root")
+		os.MkdirAll(root, 0750)
+		os.WriteFile(filepath.Join(root, "f"), []byte{1, 2, 3}, 0640)
+		os.Link(filepath.Join(root, "f"), filepath.Join(root, "link"))
+		d := indexTestDir(t, filepath.Join(dir, "checksum.db"), root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+		defer d.Close()
+		s := index.NewFileIndexer(d, 4)
+		err := s.ChecksumFiles(index.ChecksumOpt{Algorithm: "sha256", MaxSize: -1, Rate: 0})
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		if s.Stats().NFiles != 1 {
+			t.Errorf("Read %d file(s), expected hard links to be read once", s.Stats().NFiles)
+		}
+		for _, path := range []string{"f", "link"} {
+			id, err := d.GetId(path)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			e, err := d.GetEntry(id)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			if e.Checksum == "" {
+				t.Errorf("No checksum for %s", path)
+			}
+		}
+	})
+}
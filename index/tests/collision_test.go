@@ -0,0 +1,118 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index"
+	"github.com/aportelli/hyperspace/index/db"
+	"github.com/aportelli/hyperspace/index/hash"
+)
+
+// Legacy hasher for which names ending with collide2 have the hash of the same
+// name ending with collide1, and so have their children with identical names
+type collideHasher struct{}
+
+func (collideHasher) Name() string { return "test-collide" }
+func (collideHasher) Version() int { return 1 }
+func (collideHasher) Digits() int  { return 12 }
+func (collideHasher) Hash(s string) int64 {
+	if strings.HasSuffix(s, "collide2") {
+		s = strings.TrimSuffix(s, "2") + "1"
+	}
+	return hash.Md548(s)
+}
+
+func TestCollision(t *testing.T) {
+	dir := t.TempDir()
+	hash.RegisterHasher(collideHasher{})
+	root := filepath.Join(dir, "collision_root")
+	dbPath := filepath.Join(dir, "collision.db")
+	paths := []string{"collide1/f", "collide2/f", "a/collide1", "a/collide2"}
+	for _, p := range paths {
+		os.MkdirAll(filepath.Join(root, filepath.Dir(p)), 0750)
+		os.WriteFile(filepath.Join(root, p), []byte(p), 0640)
+	}
+	d := indexTestDir(t, dbPath, root, db.IndexDbOpt{Reset: true, BatchSize: 10000, Hasher: "test-collide"})
+	if d.Collisions != 3 {
+		t.Errorf("Got %d collisions, expected 3", d.Collisions)
+	}
+	check := func(t *testing.T, d *db.IndexDb) map[string]int64 {
+		ids := make(map[string]int64)
+		seen := make(map[int64]string)
+		for _, p := range append(paths, "collide1", "collide2") {
+			id, err := d.GetId(p)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			if q, ok := seen[id]; ok {
+				t.Errorf("Paths %s and %s have the same id %x", p, q, id)
+			}
+			seen[id] = p
+			ids[p] = id
+			path, err := d.GetPath(id)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			if path != p {
+				t.Errorf("Got path %s for id %x, expected %s", path, id, p)
+			}
+		}
+		return ids
+	}
+	ids := check(t, d)
+	d.Close()
+
+	t.Run("update", func(t *testing.T) {
+		d := indexTestDir(t, dbPath, root, db.IndexDbOpt{Update: true, BatchSize: 10000})
+		defer d.Close()
+		if d.Insertions != 0 || d.Deletions != 0 {
+			t.Errorf("Got %d insertion(s) and %d deletion(s), expected none", d.Insertions, d.Deletions)
+		}
+		for p, id := range check(t, d) {
+			if ids[p] != id {
+				t.Errorf("Id of %s changed from %x to %x", p, ids[p], id)
+			}
+		}
+	})
+
+	t.Run("rescan", func(t *testing.T) {
+		d, err := db.NewIndexDb(dbPath, db.IndexDbOpt{Reset: true, BatchSize: 10000, Hasher: "test-collide"})
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		defer d.Close()
+		s := index.NewFileIndexer(d, 4)
+		err = s.IndexDir(root)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		insertions := d.Insertions
+		err = s.IndexDir(root)
+		if err == nil {
+			t.Errorf("Scanned the same tree twice without update")
+		}
+		if d.Collisions != 3 || d.Insertions != insertions {
+			t.Errorf("Got %d collisions and %d insertions rescanning, expected 3 and %d", d.Collisions,
+				d.Insertions, insertions)
+		}
+	})
+}
@@ -0,0 +1,92 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestDiff(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "diff_root")
+	oldPath := filepath.Join(dir, "diff_old.db")
+	opt := db.IndexDbOpt{Reset: true, BatchSize: 10000}
+	os.MkdirAll(filepath.Join(root, "a/b"), 0750)
+	os.WriteFile(filepath.Join(root, "a/f1"), make([]byte, 10), 0640)
+	os.WriteFile(filepath.Join(root, "a/b/f2"), make([]byte, 20), 0640)
+	os.WriteFile(filepath.Join(root, "f3"), make([]byte, 30), 0640)
+	d := indexTestDir(t, oldPath, root, opt)
+	err := d.ComputeRollups()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	d.Close()
+
+	os.WriteFile(filepath.Join(root, "a/f1"), make([]byte, 110), 0640)
+	os.RemoveAll(filepath.Join(root, "a/b"))
+	os.WriteFile(filepath.Join(root, "f4"), make([]byte, 1000), 0640)
+	d = indexTestDir(t, filepath.Join(dir, "diff_new.db"), root, opt)
+	defer d.Close()
+	err = d.ComputeRollups()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+
+	counts := make(map[db.DiffKind]int)
+	err = d.Diff(oldPath, func(e db.DiffEntry) error {
+		counts[e.Kind]++
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	expected := map[db.DiffKind]int{db.DiffAdded: 1, db.DiffRemoved: 2, db.DiffResized: 1, db.DiffModified: 0}
+	for k, n := range expected {
+		if counts[k] != n {
+			t.Errorf("Got %d %s entries, expected %d", counts[k], k.String(), n)
+		}
+	}
+
+	deltas, err := d.DiffDirs(oldPath, 0)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if len(deltas) != 1 {
+		t.Fatalf("Got %d directory deltas at depth 0, expected 1", len(deltas))
+	}
+	oldDb, err := db.NewIndexDb(oldPath, db.IndexDbOpt{Reset: false})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer oldDb.Close()
+	oldRollup, err := oldDb.GetRollup(deltas[0].Id)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	newRollup, err := d.GetRollup(deltas[0].Id)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if deltas[0].OldSize != oldRollup.Size || deltas[0].NewSize != newRollup.Size {
+		t.Errorf("Got root sizes %d -> %d, expected %d -> %d", deltas[0].OldSize, deltas[0].NewSize,
+			oldRollup.Size, newRollup.Size)
+	}
+}
@@ -0,0 +1,185 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index"
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestDupes(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "dupes_root")
+	os.MkdirAll(filepath.Join(root, "a"), 0750)
+	os.MkdirAll(filepath.Join(root, "b"), 0750)
+	large := make([]byte, 20000)
+	for i := range large {
+		large[i] = byte(i % 251)
+	}
+	os.WriteFile(filepath.Join(root, "a/large"), large, 0640)
+	os.WriteFile(filepath.Join(root, "b/large"), large, 0640)
+	large[10000] = 0
+	os.WriteFile(filepath.Join(root, "b/large_modified"), large, 0640)
+	os.WriteFile(filepath.Join(root, "a/small"), []byte{1, 2, 3}, 0640)
+	os.WriteFile(filepath.Join(root, "b/small"), []byte{1, 2, 3}, 0640)
+	os.WriteFile(filepath.Join(root, "b/other"), []byte{1, 2, 4}, 0640)
+	d := indexTestDir(t, filepath.Join(dir, "dupes.db"), root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	defer d.Close()
+
+	// the first run also checks that -j 0 starts a worker
+	runs := []struct {
+		name    string
+		workers uint
+	}{{"first", 0}, {"cached", 4}}
+	for _, run := range runs {
+		t.Run("dupes_"+run.name, func(t *testing.T) {
+			s := index.NewFileIndexer(d, run.workers)
+			sets, err := s.FindDuplicates(index.DupesOpt{Algorithm: "sha256", MinSize: 1})
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			if len(sets) != 2 {
+				t.Fatalf("Got %d duplicate sets, expected 2", len(sets))
+			}
+			if sets[0].Size != 20000 || len(sets[0].Ids) != 2 || sets[0].Reclaimable() != 20000 {
+				t.Errorf("Got set of %d file(s) of size %d, expected 2 files of size 20000",
+					len(sets[0].Ids), sets[0].Size)
+			}
+			if sets[1].Size != 3 || len(sets[1].Ids) != 2 {
+				t.Errorf("Got set of %d file(s) of size %d, expected 2 files of size 3",
+					len(sets[1].Ids), sets[1].Size)
+			}
+		})
+	}
+}
+
+func TestDupesPartial(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "dupes_root")
+	dbPath := filepath.Join(dir, "dupes.db")
+	os.MkdirAll(root, 0750)
+	content := make([]byte, 20000)
+	os.WriteFile(filepath.Join(root, "cached"), content, 0640)
+	d := indexTestDir(t, dbPath, root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	s := index.NewFileIndexer(d, 4)
+	err := s.ChecksumFiles(index.ChecksumOpt{Algorithm: "sha256", MaxSize: -1})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	d.Close()
+
+	// files of the same size which differ from the first block on only need
+	// partial reads, even if one of them has a known checksum, and a copy of
+	// the file with a known checksum is the only one read entirely
+	os.WriteFile(filepath.Join(root, "copy"), content, 0640)
+	for i, name := range []string{"a", "b", "c"} {
+		content[0] = byte(i + 1)
+		os.WriteFile(filepath.Join(root, name), content, 0640)
+	}
+	d = indexTestDir(t, dbPath, root, db.IndexDbOpt{Update: true, BatchSize: 10000})
+	defer d.Close()
+	s = index.NewFileIndexer(d, 4)
+	sets, err := s.FindDuplicates(index.DupesOpt{Algorithm: "sha256", MinSize: 1})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if len(sets) != 1 || len(sets[0].Ids) != 2 {
+		t.Errorf("Got %v, expected a single set of 2 files", sets)
+	}
+	if s.Stats().TotalSize != 5*2*4096+20000 {
+		t.Errorf("Read %d bytes, expected the first and last blocks of 5 files and a whole file",
+			s.Stats().TotalSize)
+	}
+}
+
+func TestDupeDirs(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "dupe_dirs_root")
+	for _, dir := range []string{"x/d1", "y/copy", "z/other"} {
+		os.MkdirAll(filepath.Join(root, dir, "sub"), 0750)
+		os.WriteFile(filepath.Join(root, dir, "a"), []byte{1, 2, 3}, 0640)
+		os.WriteFile(filepath.Join(root, dir, "sub/b"), []byte{4, 5}, 0640)
+	}
+	os.WriteFile(filepath.Join(root, "z/other/c"), []byte{6}, 0640)
+	os.MkdirAll(filepath.Join(root, "empty1"), 0750)
+	os.MkdirAll(filepath.Join(root, "empty2"), 0750)
+	d := indexTestDir(t, filepath.Join(dir, "dupe_dirs.db"), root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	defer d.Close()
+	err := d.ComputeRollups()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	missing, err := d.ComputeMerkleHashes()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if missing != 7 {
+		t.Errorf("Got %d files without checksum, expected 7", missing)
+	}
+	sets, err := d.GetDuplicateDirs()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	// the sub directories of x/d1 and y/copy are nested in the first set but
+	// z/other/sub is a copy outside of it
+	if len(sets) != 2 || len(sets[0].Ids) != 2 || len(sets[1].Ids) != 3 {
+		t.Fatalf("Got %v, expected sets of 2 and 3 directories", sets)
+	}
+	for i, path := range []string{"x/d1", "y/copy"} {
+		id, err := d.GetId(path)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		if sets[0].Ids[i] != id && sets[0].Ids[1-i] != id {
+			t.Errorf("%s not in duplicate set", path)
+		}
+	}
+}
+
+func TestDupeDirsSiblings(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "dupe_dirs_root")
+	for _, sub := range []string{"p1/s1", "p1/s2", "p2/s1", "p2/s2", "l1", "l2"} {
+		os.MkdirAll(filepath.Join(root, sub), 0750)
+		os.WriteFile(filepath.Join(root, sub, "f"), []byte{1, 2, 3}, 0640)
+	}
+	os.Symlink("x", filepath.Join(root, "l1/link"))
+	os.Symlink("y", filepath.Join(root, "l2/link"))
+	d := indexTestDir(t, filepath.Join(dir, "dupe_dirs.db"), root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	defer d.Close()
+	err := d.ComputeRollups()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	_, err = d.ComputeMerkleHashes()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	sets, err := d.GetDuplicateDirs()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	// the siblings s1 and s2 are duplicates within p1 and p2, while l1 and l2
+	// differ by their link targets
+	if len(sets) != 2 || len(sets[0].Ids) != 2 || len(sets[1].Ids) != 4 {
+		t.Fatalf("Got %v, expected sets of 2 and 4 directories", sets)
+	}
+}
@@ -0,0 +1,78 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index"
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestExclude(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "exclude_root")
+	for _, dir := range []string{"src/node_modules/m", "src/lib", "build", "deep/a/b"} {
+		os.MkdirAll(filepath.Join(root, dir), 0750)
+	}
+	for _, file := range []string{"src/main.go", "src/main.log", "src/keep.log", "src/x.tmp",
+		"src/node_modules/m/index.js", "build/out", "deep/a/b/f"} {
+		os.WriteFile(filepath.Join(root, file), []byte{1}, 0640)
+	}
+	os.WriteFile(filepath.Join(root, "src/.hsignore"), []byte("# comment\n*.tmp\n/node_modules/\n"), 0640)
+
+	d, err := db.NewIndexDb(filepath.Join(dir, "exclude.db"), db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer d.Close()
+	s := index.NewFileIndexer(d, 4)
+	s.ScanOpt = index.ScanOpt{
+		Exclude:     []string{"*.log", "/build"},
+		Include:     []string{"keep.log"},
+		IgnoreFiles: []string{".hsignore"},
+		MaxDepth:    2,
+	}
+	err = s.IndexDir(root)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+
+	for _, path := range []string{"src/main.go", "src/keep.log", "src/lib", "src/.hsignore", "deep/a"} {
+		_, err := d.GetId(path)
+		if err != nil {
+			t.Errorf("Path %s not in the index", path)
+		}
+	}
+	for _, path := range []string{"src/main.log", "src/x.tmp", "src/node_modules", "build", "deep/a/b"} {
+		_, err := d.GetId(path)
+		if err == nil {
+			t.Errorf("Excluded path %s in the index", path)
+		}
+	}
+	roots, err := d.GetRoots()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	excluded := strings.Join(roots[0].Excluded, "\n")
+	if excluded != "build\nsrc/node_modules" && excluded != "src/node_modules\nbuild" {
+		t.Errorf("Got excluded subtrees %q", excluded)
+	}
+}
@@ -0,0 +1,90 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestHardLink(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "hardlink_root")
+	dbPath := filepath.Join(dir, "hardlink.db")
+	os.MkdirAll(filepath.Join(root, "a"), 0750)
+	os.MkdirAll(filepath.Join(root, "b"), 0750)
+	os.WriteFile(filepath.Join(root, "a/f"), make([]byte, 10000), 0640)
+	os.Link(filepath.Join(root, "a/f"), filepath.Join(root, "b/f"))
+	os.Link(filepath.Join(root, "a/f"), filepath.Join(root, "b/g"))
+
+	check := func(t *testing.T, d *db.IndexDb, names []string) {
+		rootId, err := d.GetId("")
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		r, err := d.GetRollup(rootId)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		dirSize := r.LinkSize - int64(len(names))*10000
+		if r.Size-dirSize != 10000 {
+			t.Errorf("Got file size %d, expected 10000", r.Size-dirSize)
+		}
+		if r.NFiles != int64(len(names)) {
+			t.Errorf("Got %d files, expected %d", r.NFiles, len(names))
+		}
+		nprimary := 0
+		for _, name := range names {
+			id, err := d.GetId(name)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			e, err := d.GetEntry(id)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			if !e.Secondary {
+				nprimary++
+			}
+		}
+		if nprimary != 1 {
+			t.Errorf("Got %d primary links, expected 1", nprimary)
+		}
+	}
+
+	d := indexTestDir(t, dbPath, root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	err := d.ComputeRollups()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	check(t, d, []string{"a/f", "b/f", "b/g"})
+	d.Close()
+
+	t.Run("update", func(t *testing.T) {
+		os.Remove(filepath.Join(root, "a/f"))
+		d := indexTestDir(t, dbPath, root, db.IndexDbOpt{Update: true, BatchSize: 10000})
+		defer d.Close()
+		err := d.ComputeRollups()
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		check(t, d, []string{"b/f", "b/g"})
+	})
+}
@@ -0,0 +1,90 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestHasher(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "hasher.db")
+	d := indexTestDir(t, dbPath, testRoot, db.IndexDbOpt{Reset: true, BatchSize: 10000, Hasher: "xxh64"})
+	scheme, err := d.GetValue("hash_scheme")
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if scheme.(string) != "xxh64" {
+		t.Errorf("Got hash scheme %s, expected xxh64", scheme)
+	}
+	for _, path := range []string{"Hôtel/été", ".git/hooks/commit-msg.sample", "index/tests/index_test.go"} {
+		id, err := d.GetId(path)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		if id < 0 {
+			t.Errorf("Got negative id %x", id)
+		}
+		idPath, err := d.GetPath(id)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		if idPath != path {
+			t.Errorf("Got path %s, expected %s", idPath, path)
+		}
+	}
+	d.Close()
+
+	_, err = db.NewIndexDb(dbPath, db.IndexDbOpt{Update: true, Hasher: "md5-48"})
+	if err == nil {
+		t.Errorf("Opened xxh64 index with the md5-48 scheme")
+	}
+	d, err = db.NewIndexDb(dbPath, db.IndexDbOpt{Update: true})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer d.Close()
+	if d.Hasher.Name() != "xxh64" {
+		t.Errorf("Got hash scheme %s, expected xxh64", d.Hasher.Name())
+	}
+
+	raw, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer raw.Close()
+	var hexId string
+	err = raw.QueryRow("SELECT id FROM view_tree_hex WHERE parent_id IS NULL").Scan(&hexId)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if len(hexId) != d.Hasher.Digits() {
+		t.Errorf("Got hexadecimal id %s, expected %d digits", hexId, d.Hasher.Digits())
+	}
+
+	md5Path := filepath.Join(t.TempDir(), "hasher_md5.db")
+	md5Db := indexTestDir(t, md5Path, testRoot, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	md5Db.Close()
+	err = d.Diff(md5Path, func(e db.DiffEntry) error { return nil })
+	if err == nil {
+		t.Errorf("Compared indexes with different hash schemes")
+	}
+}
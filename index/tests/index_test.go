@@ -22,11 +22,11 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
 	"strings"
 	"testing"
 
-	"github.com/aportelli/hyperspace/index"
 	"github.com/aportelli/hyperspace/index/db"
 )
 
@@ -61,20 +61,12 @@ type pathTest struct {
 }
 
 func TestIndex(t *testing.T) {
+	dir := t.TempDir()
 	var d *db.IndexDb
 
+	// the root is legacy so that the ids are the path hashes computed by hash.sh
 	t.Run("indexing", func(t *testing.T) {
-		var err error
-		opt := db.IndexDbOpt{Reset: true, BatchSize: 10000}
-		d, err = db.NewIndexDb(filepath.Join(testDir, "test.db"), opt)
-		if err != nil {
-			t.Errorf("Got error %s", err.Error())
-		}
-		s := index.NewFileIndexer(d, 4)
-		err = s.IndexDir(filepath.Join(testDir, "test_root"))
-		if err != nil {
-			t.Errorf("Got error %s", err.Error())
-		}
+		d = indexLegacyDir(t, filepath.Join(dir, "test.db"), testRoot)
 	})
 
 	paths := []pathTest{
@@ -139,5 +131,39 @@ func TestIndex(t *testing.T) {
 		})
 	}
 
+	findTests := []struct {
+		name  string
+		start string
+		opt   func(*db.FindOpt)
+		count int
+	}{
+		{"glob", "", func(o *db.FindOpt) { o.Glob = "*.go" }, 11},
+		{"glob_subtree", "index", func(o *db.FindOpt) { o.Glob = "*.go" }, 6},
+		{"regex", "", func(o *db.FindOpt) { o.Regex = regexp.MustCompile(`\.sample$`) }, 13},
+		{"type_depth", "index", func(o *db.FindOpt) { o.Type = "d"; o.MinDepth = 1; o.MaxDepth = 1 }, 1},
+		{"size", "cmd", func(o *db.FindOpt) { o.Type = "f"; o.MinSize = 5; o.MaxSize = 5 }, 4},
+	}
+	for _, test := range findTests {
+		t.Run("find_"+test.name, func(t *testing.T) {
+			id, err := d.GetId(test.start)
+			if err != nil {
+				t.Errorf("Got error %s", err.Error())
+			}
+			opt := db.NewFindOpt(id)
+			test.opt(&opt)
+			count := 0
+			err = d.Find(opt, func(id int64, name string) error {
+				count++
+				return nil
+			})
+			if err != nil {
+				t.Errorf("Got error %s", err.Error())
+			}
+			if count != test.count {
+				t.Errorf("Got %d result(s), expected %d", count, test.count)
+			}
+		})
+	}
+
 	d.Close()
 }
@@ -0,0 +1,56 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestBatchInsert(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "batch_root")
+	const nfiles = 5000
+	for i := 0; i < nfiles; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("d%d", i%3))
+		os.MkdirAll(dir, 0750)
+		os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%04d", i)), []byte{1}, 0640)
+	}
+	d := indexTestDir(t, filepath.Join(dir, "batch.db"), root, db.IndexDbOpt{Reset: true, BatchSize: 1000})
+	defer d.Close()
+	if d.Insertions != nfiles+4 {
+		t.Errorf("Got %d insertions, expected %d", d.Insertions, nfiles+4)
+	}
+	for _, i := range []int{0, 1234, nfiles - 1} {
+		path := fmt.Sprintf("d%d/f%04d", i%3, i)
+		id, err := d.GetId(path)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		entry, err := d.GetEntry(id)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		if entry.Depth != 2 || entry.Size != 1 {
+			t.Errorf("Got depth %d and size %d for %s, expected 2 and 1", entry.Depth, entry.Size, path)
+		}
+	}
+}
@@ -0,0 +1,199 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+// Copy an index into a database with the first schema version, where the
+// children of the root have depth 0 if oldDepths is true and 1 otherwise.
+func makeV1Db(t *testing.T, src string, dst string, oldDepths bool) {
+	os.RemoveAll(dst)
+	v1, err := sql.Open("sqlite3", dst)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer v1.Close()
+	for _, q := range []string{
+		"CREATE TABLE key_value (key TEXT PRIMARY KEY, value TEXT)",
+		`CREATE TABLE tree (id INT PRIMARY KEY, parent_id INT NULL REFERENCES tree (id), path TEXT NOT NULL,
+			depth INT NOT NULL, name TEXT NOT NULL, type TEXT NOT NULL, size INT NOT NULL)`,
+		`CREATE VIEW view_tree_hex AS SELECT printf("%012x",id) AS id, path, depth, name, type, size FROM tree`,
+		fmt.Sprintf("ATTACH DATABASE '%s' AS src", src),
+		"INSERT INTO key_value SELECT 'root_abs', path FROM src.roots",
+		"INSERT INTO key_value SELECT 'root_input', input FROM src.roots",
+	} {
+		_, err = v1.Exec(q)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+	}
+	_, err = v1.Exec(`INSERT INTO tree SELECT id, parent_id, path, MAX(depth - (parent_id IS NOT NULL AND ?), 0), name,
+		type, size FROM src.tree`, oldDepths)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "migrate_src.db")
+	dbPath := filepath.Join(dir, "migrate.db")
+	d := indexLegacyDir(t, srcPath, testRoot)
+	err := d.ComputeRollups()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	rootId, err := d.GetId("")
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	expected, err := d.GetRollup(rootId)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	id, err := d.GetId("index/tests")
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	entry, err := d.GetEntry(id)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	d.Close()
+	makeV1Db(t, srcPath, dbPath, true)
+	absRoot, _ := filepath.Abs(testRoot)
+
+	// a read-only index is not upgraded but its roots can be read
+	d, err = db.OpenReadOnly(dbPath)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	roots, err := d.GetRoots()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if len(roots) != 1 || roots[0].Path != absRoot || roots[0].Input != testRoot {
+		t.Errorf("Got roots %v, expected '%s' only", roots, absRoot)
+	}
+	if _, err = d.GetValue("schema_version"); err != sql.ErrNoRows {
+		t.Errorf("Got error %v reading the schema version, expected no version", err)
+	}
+	d.Close()
+
+	d, err = db.NewIndexDb(dbPath, db.IndexDbOpt{Reset: false})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if _, err = os.Stat(dbPath + ".v1.bak"); err != nil {
+		t.Errorf("Got error %s for the backup", err.Error())
+	}
+	version, err := d.GetValue("schema_version")
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if fmt.Sprint(version) != "3" {
+		t.Errorf("Got schema version %v, expected 3", version)
+	}
+	roots, err = d.GetRoots()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if len(roots) != 1 || roots[0].Path != absRoot || roots[0].Input != testRoot {
+		t.Errorf("Got roots %v, expected '%s' only", roots, absRoot)
+	}
+	migrated, err := d.GetEntry(id)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if migrated.Depth != entry.Depth || migrated.Name != entry.Name {
+		t.Errorf("Got entry %s at depth %d, expected %s at depth %d", migrated.Name, migrated.Depth,
+			entry.Name, entry.Depth)
+	}
+	rollup, err := d.GetRollup(rootId)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if rollup.NFiles != expected.NFiles || rollup.NDirs != expected.NDirs {
+		t.Errorf("Got %d files and %d directories after migration, expected %d and %d", rollup.NFiles,
+			rollup.NDirs, expected.NFiles, expected.NDirs)
+	}
+	snapshots, err := d.GetSnapshots()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if len(snapshots) != 1 {
+		t.Errorf("Got %d snapshots, expected 1", len(snapshots))
+	}
+	d.Close()
+
+	d = indexTestDir(t, dbPath, testRoot, db.IndexDbOpt{Update: true, BatchSize: 10000})
+	if d.Insertions != 0 || d.Deletions != 0 {
+		t.Errorf("Got %d insertion(s) and %d deletion(s) updating a migrated index, expected none",
+			d.Insertions, d.Deletions)
+	}
+	d.Close()
+}
+
+// Indexes built before schema versions were recorded may already have the
+// current depths
+func TestMigrateDepths(t *testing.T) {
+	dir := t.TempDir()
+	srcPath := filepath.Join(dir, "migrate_src.db")
+	dbPath := filepath.Join(dir, "migrate.db")
+	d := indexLegacyDir(t, srcPath, testRoot)
+	id, err := d.GetId("index/tests")
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	d.Close()
+	makeV1Db(t, srcPath, dbPath, false)
+	d, err = db.NewIndexDb(dbPath, db.IndexDbOpt{Reset: false})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer d.Close()
+	e, err := d.GetEntry(id)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if e.Depth != 2 {
+		t.Errorf("Got depth %d for index/tests, expected 2", e.Depth)
+	}
+}
+
+func TestMigrateNewer(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "migrate_newer.db")
+	d := indexTestDir(t, dbPath, testRoot, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	err := d.SetValue("schema_version", 99)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	d.Close()
+	_, err = db.NewIndexDb(dbPath, db.IndexDbOpt{Reset: false})
+	if err == nil {
+		t.Errorf("Opened an index with a newer schema version")
+	}
+}
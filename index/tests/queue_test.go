@@ -0,0 +1,63 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index"
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestScanOrder(t *testing.T) {
+	dir := t.TempDir()
+	var nfiles []uint64
+	for _, workers := range []uint{1, 8} {
+		for _, depthFirst := range []bool{false, true} {
+			dbPath := filepath.Join(dir, fmt.Sprintf("queue_%d_%v.db", workers, depthFirst))
+			d, err := db.NewIndexDb(dbPath, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			s := index.NewFileIndexer(d, workers)
+			s.ScanOpt.DepthFirst = depthFirst
+			err = s.IndexDir(testRoot)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			_, err = d.GetId("index/tests/index_test.go")
+			if err != nil {
+				t.Errorf("Got error %s with %d worker(s), depth-first %v", err.Error(), workers, depthFirst)
+			}
+			stats := s.Stats()
+			if stats.QueuedDirs != 0 || stats.ActiveWorkers != 0 {
+				t.Errorf("Got %d queued directories and %d active workers after the scan", stats.QueuedDirs,
+					stats.ActiveWorkers)
+			}
+			nfiles = append(nfiles, stats.NFiles)
+			d.Close()
+		}
+	}
+	for _, n := range nfiles[1:] {
+		if n != nfiles[0] {
+			t.Errorf("Got file counts %v depending on the scan order", nfiles)
+			break
+		}
+	}
+}
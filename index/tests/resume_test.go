@@ -0,0 +1,233 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aportelli/hyperspace/index"
+	"github.com/aportelli/hyperspace/index/db"
+	"github.com/aportelli/hyperspace/index/hash"
+)
+
+// Index root, interrupting the scan once n files have been scanned, and return
+// whether the scan was interrupted. A completed index is installed.
+func indexInterrupted(t *testing.T, dbPath string, root string, opt db.IndexDbOpt, n uint64) bool {
+	d, err := db.NewIndexDb(dbPath, opt)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer d.Close()
+	s := index.NewFileIndexer(d, 4)
+	s.Resume = opt.Resume
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for s.Stats().NFiles < n {
+			select {
+			case <-stop:
+				return
+			case <-time.After(time.Millisecond):
+			}
+		}
+		s.Interrupt()
+	}()
+	err = s.IndexDir(root)
+	var e *index.InterruptError
+	if errors.As(err, &e) {
+		return true
+	} else if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	err = d.CreateIndices()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	return false
+}
+
+func checkResumed(t *testing.T, d *db.IndexDb, ndirs int, nfiles int) {
+	for i := 0; i < ndirs; i++ {
+		for j := 0; j < nfiles; j += 7 {
+			path := fmt.Sprintf("d%02d/sub/f%03d", i, j)
+			if _, err := d.GetId(path); err != nil {
+				t.Errorf("Path %s not in the resumed index", path)
+			}
+		}
+	}
+	err := d.ComputeRollups()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	id, _ := d.GetId("")
+	r, err := d.GetRollup(id)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if r.NFiles != int64(ndirs*nfiles) || r.NDirs != int64(2*ndirs) {
+		t.Errorf("Got %d files and %d directories, expected %d and %d", r.NFiles, r.NDirs, ndirs*nfiles,
+			2*ndirs)
+	}
+	snapshots, err := d.GetSnapshots()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if len(snapshots) != 1 || !snapshots[0].Complete {
+		t.Errorf("Got %d snapshots, expected a single complete one", len(snapshots))
+	}
+}
+
+func TestResume(t *testing.T) {
+	const ndirs, nfiles = 20, 100
+	root := filepath.Join(t.TempDir(), "resume_root")
+	for i := 0; i < ndirs; i++ {
+		dir := filepath.Join(root, fmt.Sprintf("d%02d/sub", i))
+		os.MkdirAll(dir, 0750)
+		for j := 0; j < nfiles; j++ {
+			os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%03d", j)), []byte{1}, 0640)
+		}
+	}
+
+	t.Run("queue", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "resume.db")
+		opt := db.IndexDbOpt{Reset: true, Swap: true, BatchSize: 100}
+		if !indexInterrupted(t, dbPath, root, opt, 500) {
+			t.Skip("scan completed before being interrupted")
+		}
+
+		// each run finishes at least one directory with 4 workers
+		opt.Resume = true
+		for indexInterrupted(t, dbPath, root, opt, 500) {
+		}
+		d, err := db.NewIndexDb(dbPath, db.IndexDbOpt{})
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		checkResumed(t, d, ndirs, nfiles)
+		d.Close()
+		if _, err = os.Stat(dbPath + ".partial"); err == nil {
+			t.Errorf("Partial index left after the build completed")
+		}
+		_, err = db.NewIndexDb(dbPath, opt)
+		if err == nil {
+			t.Errorf("Resumed a completed index build")
+		}
+	})
+
+	t.Run("killed", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "resume_killed.db")
+		opt := db.IndexDbOpt{Reset: true, BatchSize: 100}
+		if !indexInterrupted(t, dbPath, root, opt, 500) {
+			t.Skip("scan completed before being interrupted")
+		}
+
+		// without a saved queue the directories left to scan are found from
+		// the finished ones
+		raw, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		_, err = raw.Exec("DELETE FROM checkpoint_queue")
+		raw.Close()
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		d, err := db.NewIndexDb(dbPath, db.IndexDbOpt{Resume: true, BatchSize: 100})
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		s := index.NewFileIndexer(d, 4)
+		s.Resume = true
+		err = s.IndexDir(root)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		checkResumed(t, d, ndirs, nfiles)
+		err = s.IndexDir(root)
+		if err == nil {
+			t.Errorf("Resumed a completed scan")
+		}
+		d.Close()
+	})
+}
+
+func TestResumeCollision(t *testing.T) {
+	hash.RegisterHasher(collideHasher{})
+	const ndirs, nfiles = 10, 100
+	dir := t.TempDir()
+	root := filepath.Join(dir, "resume_root")
+	dbPath := filepath.Join(dir, "resume.db")
+	for i := 0; i < ndirs; i++ {
+		for _, sub := range []string{"collide1", "collide2"} {
+			subDir := filepath.Join(root, fmt.Sprintf("d%02d/%s", i, sub))
+			os.MkdirAll(subDir, 0750)
+			for j := 0; j < nfiles; j++ {
+				os.WriteFile(filepath.Join(subDir, fmt.Sprintf("f%03d", j)), []byte{1}, 0640)
+			}
+		}
+	}
+	opt := db.IndexDbOpt{Reset: true, BatchSize: 100, Hasher: "test-collide"}
+	if !indexInterrupted(t, dbPath, root, opt, 500) {
+		t.Skip("scan completed before being interrupted")
+	}
+
+	// the checkpoint holds the resolved ids of the colliding directories
+	raw, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	var n int
+	r := raw.QueryRow(`SELECT (SELECT COUNT(*) FROM checkpoint_queue q JOIN tree t ON t.id = q.id
+			WHERE t.name != substr(q.path, length(q.path) - length(t.name) + 1))
+		+ (SELECT COUNT(*) FROM checkpoint_done WHERE id NOT IN (SELECT id FROM tree))`)
+	err = r.Scan(&n)
+	raw.Close()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if n != 0 {
+		t.Errorf("Got %d checkpointed directories with a nominal id", n)
+	}
+
+	opt = db.IndexDbOpt{Resume: true, BatchSize: 100}
+	for indexInterrupted(t, dbPath, root, opt, 500) {
+	}
+	d, err := db.NewIndexDb(dbPath, db.IndexDbOpt{})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer d.Close()
+	for i := 0; i < ndirs; i++ {
+		for _, sub := range []string{"collide1", "collide2"} {
+			path := fmt.Sprintf("d%02d/%s/f%03d", i, sub, nfiles-1)
+			id, err := d.GetId(path)
+			if err != nil {
+				t.Fatalf("Path %s not in the resumed index", path)
+			}
+			p, err := d.GetPath(id)
+			if err != nil || p != path {
+				t.Errorf("Got path %s for %s", p, path)
+			}
+		}
+	}
+}
@@ -0,0 +1,132 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestRollup(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "rollup_root")
+	os.MkdirAll(filepath.Join(root, "a/b/c"), 0750)
+	os.MkdirAll(filepath.Join(root, "d"), 0750)
+	os.WriteFile(filepath.Join(root, "a/f1"), make([]byte, 100), 0640)
+	os.WriteFile(filepath.Join(root, "a/b/c/f2"), make([]byte, 1000), 0640)
+	os.WriteFile(filepath.Join(root, "d/f3"), make([]byte, 10), 0640)
+	d := indexTestDir(t, filepath.Join(dir, "rollup.db"), root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	defer d.Close()
+	err := d.ComputeRollups()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+
+	tests := []struct {
+		path   string
+		nfiles int64
+		ndirs  int64
+		size   int64
+	}{
+		{"", 3, 4, 1110},
+		{"a", 2, 2, 1100},
+		{"a/b/c", 1, 0, 1000},
+		{"d", 1, 0, 10},
+	}
+	for _, test := range tests {
+		t.Run("rollup_"+test.path, func(t *testing.T) {
+			id, err := d.GetId(test.path)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			r, err := d.GetRollup(id)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			if r.NFiles != test.nfiles || r.NDirs != test.ndirs {
+				t.Errorf("Got %d file(s) and %d dir(s), expected %d and %d", r.NFiles, r.NDirs,
+					test.nfiles, test.ndirs)
+			}
+			var dirSize int64
+			err = d.Find(db.NewFindOpt(id), func(id int64, name string) error {
+				e, err := d.GetEntry(id)
+				if e.Type == "d" {
+					dirSize += e.Size
+				}
+				return err
+			})
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			if r.Size != test.size+dirSize {
+				t.Errorf("Got size %d, expected %d", r.Size, test.size+dirSize)
+			}
+		})
+	}
+
+	t.Run("largest", func(t *testing.T) {
+		id, err := d.GetId("a")
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		entries, err := d.GetLargest(id, "f", 1, false, false)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		if len(entries) != 1 || entries[0].Name != "f2" {
+			t.Errorf("Got %v, expected f2", entries)
+		}
+		entries, err = d.GetSubtreeUsage(id, 1)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		if len(entries) != 2 {
+			t.Errorf("Got %d entries, expected 2", len(entries))
+		}
+	})
+}
+
+func TestLargestLinks(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "links_root")
+	os.MkdirAll(filepath.Join(root, "a"), 0750)
+	os.WriteFile(filepath.Join(root, "a/f"), make([]byte, 100), 0640)
+	os.Link(filepath.Join(root, "a/f"), filepath.Join(root, "g"))
+	os.WriteFile(filepath.Join(root, "h"), make([]byte, 10), 0640)
+	d := indexTestDir(t, filepath.Join(dir, "links.db"), root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	defer d.Close()
+	id, err := d.GetId("")
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	for _, links := range []bool{false, true} {
+		entries, err := d.GetLargest(id, "f", 10, false, links)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		expected := 2
+		if links {
+			expected = 3
+		}
+		if len(entries) != expected {
+			t.Errorf("Got %d files with links %v, expected %d", len(entries), links, expected)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestRoots(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "roots.db")
+	roots := []string{filepath.Join(dir, "roots_a"), filepath.Join(dir, "roots_b")}
+	for _, root := range roots {
+		os.MkdirAll(filepath.Join(root, "x"), 0750)
+		os.WriteFile(filepath.Join(root, "x/f"), []byte(root), 0640)
+		os.WriteFile(filepath.Join(root, "g"), []byte{1}, 0640)
+	}
+	d := indexTestDir(t, dbPath, roots[0], db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	d.Close()
+	d = indexTestDir(t, dbPath, roots[1], db.IndexDbOpt{Update: true, BatchSize: 10000})
+	if d.Deletions != 0 {
+		t.Errorf("Got %d deletion(s) adding a root, expected none", d.Deletions)
+	}
+	d.Close()
+
+	check := func(t *testing.T) {
+		d, err := db.NewIndexDb(dbPath, db.IndexDbOpt{})
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		defer d.Close()
+		indexed, err := d.GetRoots()
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		if len(indexed) != len(roots) {
+			t.Fatalf("Got %d roots, expected %d", len(indexed), len(roots))
+		}
+		seen := make(map[int64]string)
+		for i, root := range roots {
+			if indexed[i].Path != root {
+				t.Errorf("Got root %s, expected %s", indexed[i].Path, root)
+			}
+			path := filepath.Join(root, "x/f")
+			id, err := d.GetId(path)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			if p, ok := seen[id]; ok {
+				t.Errorf("Paths %s and %s have the same id %x", path, p, id)
+			}
+			seen[id] = path
+			fullPath, err := d.GetFullPath(id)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			if fullPath != path {
+				t.Errorf("Got path %s for id %x, expected %s", fullPath, id, path)
+			}
+			top, err := d.GetRootEntryId(indexed[i].Id)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			n := 0
+			opt := db.NewFindOpt(top)
+			opt.Glob = "f"
+			err = d.Find(opt, func(id int64, name string) error {
+				n++
+				return nil
+			})
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			if n != 1 {
+				t.Errorf("Found %d file(s) in root %s, expected 1", n, root)
+			}
+		}
+		_, err = d.GetId("x/f")
+		if err == nil {
+			t.Errorf("Resolved a relative path in an index with several roots")
+		}
+	}
+	check(t)
+
+	t.Run("update", func(t *testing.T) {
+		os.Remove(filepath.Join(roots[0], "g"))
+		d := indexTestDir(t, dbPath, roots[0], db.IndexDbOpt{Update: true, BatchSize: 10000})
+		if d.Insertions != 0 || d.Deletions != 1 {
+			t.Errorf("Got %d insertion(s) and %d deletion(s), expected 0 and 1", d.Insertions, d.Deletions)
+		}
+		d.Close()
+		check(t)
+	})
+
+	t.Run("ids", func(t *testing.T) {
+		// roots[1] is the second root of the first index and the only one of
+		// the other
+		otherPath := filepath.Join(t.TempDir(), "roots_other.db")
+		d := indexTestDir(t, otherPath, roots[1], db.IndexDbOpt{Reset: true, BatchSize: 10000})
+		defer d.Close()
+		d2, err := db.NewIndexDb(dbPath, db.IndexDbOpt{})
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		defer d2.Close()
+		path := filepath.Join(roots[1], "x/f")
+		id, err := d.GetId(path)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		id2, err := d2.GetId(path)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		if id != id2 {
+			t.Errorf("Got ids %x and %x for %s in two indexes", id, id2, path)
+		}
+	})
+}
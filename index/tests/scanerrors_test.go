@@ -0,0 +1,67 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index"
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestScanErrors(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	dir := t.TempDir()
+	root := filepath.Join(dir, "errors_root")
+	os.MkdirAll(filepath.Join(root, "locked/sub"), 0750)
+	os.WriteFile(filepath.Join(root, "f"), []byte{1}, 0640)
+	os.Chmod(filepath.Join(root, "locked"), 0)
+	defer os.Chmod(filepath.Join(root, "locked"), 0750)
+
+	d, err := db.NewIndexDb(filepath.Join(dir, "errors.db"), db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer d.Close()
+	s := index.NewFileIndexer(d, 4)
+	err = s.IndexDir(root)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if s.Stats().NErrors != 1 {
+		t.Errorf("Got %d errors, expected 1", s.Stats().NErrors)
+	}
+	errs := make([]db.ScanError, 0)
+	err = d.GetScanErrors(func(e db.ScanError) error {
+		errs = append(errs, e)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if len(errs) != 1 {
+		t.Fatalf("Got %d recorded errors, expected 1", len(errs))
+	}
+	if errs[0].Path != "locked" || errs[0].Operation != "readdir" || errs[0].Errno != int(syscall.EACCES) {
+		t.Errorf("Got error %+v", errs[0])
+	}
+}
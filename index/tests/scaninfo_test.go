@@ -0,0 +1,77 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestScanInfo(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "scaninfo.db")
+	d := indexTestDir(t, dbPath, testRoot, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	defer d.Close()
+	_, err := d.GetScanInfo()
+	if err == nil {
+		t.Errorf("Got a scan summary before recording it")
+	}
+	err = d.ComputeRollups()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	end := time.Now()
+	err = d.RecordScan(end, 3*time.Second)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	info, err := d.GetScanInfo()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	rootId, err := d.GetId("")
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	rollup, err := d.GetRollup(rootId)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if !info.Time.Equal(end) || info.Duration != 3*time.Second {
+		t.Errorf("Got scan at %v lasting %v, expected %v lasting 3s", info.Time, info.Duration, end)
+	}
+	if info.NEntries != rollup.NFiles+rollup.NDirs+1 || info.Size != rollup.Size {
+		t.Errorf("Got %d entries and size %d, expected %d and %d", info.NEntries, info.Size,
+			rollup.NFiles+rollup.NDirs+1, rollup.Size)
+	}
+
+	ro, err := db.OpenReadOnly(dbPath)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer ro.Close()
+	roInfo, err := ro.GetScanInfo()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if *roInfo != *info {
+		t.Errorf("Got scan summary %v read-only, expected %v", *roInfo, *info)
+	}
+}
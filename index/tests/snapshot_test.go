@@ -0,0 +1,181 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestSnapshot(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "snapshot_root")
+	dbPath := filepath.Join(dir, "snapshot.db")
+	os.MkdirAll(filepath.Join(root, "a/b"), 0750)
+	os.WriteFile(filepath.Join(root, "a/f1"), make([]byte, 10), 0640)
+	os.WriteFile(filepath.Join(root, "a/b/f2"), make([]byte, 20), 0640)
+	d := indexTestDir(t, dbPath, root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	err := d.ComputeRollups()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	d.Close()
+
+	os.WriteFile(filepath.Join(root, "a/f1"), make([]byte, 110), 0640)
+	os.RemoveAll(filepath.Join(root, "a/b"))
+	for i := 0; i < 2; i++ {
+		d = indexTestDir(t, dbPath, root, db.IndexDbOpt{Update: true, BatchSize: 10000})
+		err = d.ComputeRollups()
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		d.Close()
+	}
+	d, err = db.NewIndexDb(dbPath, db.IndexDbOpt{Reset: false})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer d.Close()
+
+	snapshots, err := d.GetSnapshots()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if len(snapshots) != 3 {
+		t.Fatalf("Got %d snapshots, expected 3", len(snapshots))
+	}
+	for _, s := range snapshots {
+		if !s.Complete {
+			t.Errorf("Snapshot %d is incomplete", s.Id)
+		}
+	}
+	if snapshots[0].NEntries != 5 || snapshots[2].NEntries != 3 {
+		t.Errorf("Got %d and %d entries, expected 5 and 3", snapshots[0].NEntries, snapshots[2].NEntries)
+	}
+	firstSize := snapshots[0].Size
+
+	id, err := d.GetId("a")
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	versions, err := d.GetRollupHistory(id)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if len(versions) != 2 {
+		t.Fatalf("Got %d rollup versions, expected 2", len(versions))
+	}
+	if versions[0].End != snapshots[0].Id || versions[1].Start != snapshots[1].Id ||
+		versions[1].End != snapshots[2].Id {
+		t.Errorf("Got rollup versions %d-%d and %d-%d", versions[0].Start, versions[0].End,
+			versions[1].Start, versions[1].End)
+	}
+	if versions[0].NFiles != 2 || versions[1].NFiles != 1 {
+		t.Errorf("Got %d and %d files, expected 2 and 1", versions[0].NFiles, versions[1].NFiles)
+	}
+
+	t.Run("export", func(t *testing.T) {
+		exportPath := filepath.Join(dir, "snapshot_export.db")
+		err := d.ExportSnapshot(snapshots[0].Id, exportPath)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		e, err := db.NewIndexDb(exportPath, db.IndexDbOpt{Reset: false})
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		defer e.Close()
+		for _, path := range []string{"a/b", "a/b/f2"} {
+			_, err := e.GetId(path)
+			if err != nil {
+				t.Errorf("Path %s not in exported snapshot", path)
+			}
+		}
+		fid, err := e.GetId("a/f1")
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		entry, err := e.GetEntry(fid)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		if entry.Size != 10 {
+			t.Errorf("Got size %d, expected 10", entry.Size)
+		}
+		rootId, err := e.GetId("")
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		r, err := e.GetRollup(rootId)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		if r.Size != firstSize {
+			t.Errorf("Got root size %d, expected %d", r.Size, firstSize)
+		}
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		pruned, err := d.PruneSnapshots(db.PruneOpt{KeepLast: 1})
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		if len(pruned) != 2 {
+			t.Errorf("Pruned %d snapshots, expected 2", len(pruned))
+		}
+		versions, err := d.GetRollupHistory(id)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		if len(versions) != 1 {
+			t.Errorf("Got %d rollup versions after pruning, expected 1", len(versions))
+		}
+	})
+}
+
+func TestSnapshotPruneRoots(t *testing.T) {
+	dir := t.TempDir()
+	dbPath := filepath.Join(dir, "snapshot.db")
+	roots := []string{filepath.Join(dir, "r1"), filepath.Join(dir, "r2")}
+	for _, r := range roots {
+		os.MkdirAll(r, 0750)
+		os.WriteFile(filepath.Join(r, "f"), []byte{1}, 0640)
+	}
+	for _, r := range []string{roots[0], roots[1], roots[1]} {
+		d := indexTestDir(t, dbPath, r, db.IndexDbOpt{Update: true, BatchSize: 10000})
+		d.Close()
+	}
+	d, err := db.NewIndexDb(dbPath, db.IndexDbOpt{Reset: false})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer d.Close()
+	snapshots, err := d.GetSnapshots()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	pruned, err := d.PruneSnapshots(db.PruneOpt{KeepLast: 1})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if len(pruned) != 1 || pruned[0] != snapshots[1].Id {
+		t.Errorf("Pruned snapshots %v, expected [%d]", pruned, snapshots[1].Id)
+	}
+}
@@ -0,0 +1,122 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestSwap(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(t.TempDir(), "swap_root")
+	dbPath := filepath.Join(dir, "swap.db")
+	os.MkdirAll(filepath.Join(root, "a"), 0750)
+	os.WriteFile(filepath.Join(root, "a/f1"), []byte{1}, 0640)
+	opt := db.IndexDbOpt{Reset: true, Swap: true, BatchSize: 10000}
+	d := indexTestDir(t, dbPath, root, opt)
+	err := d.CreateIndices()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	_, err = d.GetId("a/f1")
+	if err != nil {
+		t.Errorf("Got error %s after installing the index", err.Error())
+	}
+	d.Close()
+
+	// an unfinished rebuild leaves the previous index untouched
+	os.Remove(filepath.Join(root, "a/f1"))
+	os.WriteFile(filepath.Join(root, "a/f2"), []byte{1}, 0640)
+	d = indexTestDir(t, dbPath, root, opt)
+	old, err := db.NewIndexDb(dbPath, db.IndexDbOpt{})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	_, err = old.GetId("a/f1")
+	if err != nil {
+		t.Errorf("Got error %s querying the previous index during a rebuild", err.Error())
+	}
+	old.Close()
+	d.Close()
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Got %d files after a discarded rebuild, expected 1", len(entries))
+	}
+	old, err = db.NewIndexDb(dbPath, db.IndexDbOpt{})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	_, err = old.GetId("a/f1")
+	if err != nil {
+		t.Errorf("Got error %s after a discarded rebuild", err.Error())
+	}
+	old.Close()
+
+	d = indexTestDir(t, dbPath, root, opt)
+	err = d.CreateIndices()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	d.Close()
+	d, err = db.NewIndexDb(dbPath, db.IndexDbOpt{})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	defer d.Close()
+	if _, err = d.GetId("a/f2"); err != nil {
+		t.Errorf("Got error %s after a rebuild", err.Error())
+	}
+	if _, err = d.GetId("a/f1"); err == nil {
+		t.Errorf("Removed file still in the rebuilt index")
+	}
+
+	t.Run("busy", func(t *testing.T) {
+		dbPath := filepath.Join(t.TempDir(), "swap.db")
+		d := indexTestDir(t, dbPath, root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+		d.Close()
+		raw, err := sql.Open("sqlite3", dbPath)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		defer raw.Close()
+		_, err = raw.Exec("INSERT INTO key_value VALUES('swap_test', 1)")
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		tx, err := raw.Begin()
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		defer tx.Rollback()
+		var n int
+		err = tx.QueryRow("SELECT COUNT(*) FROM tree").Scan(&n)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		d = indexTestDir(t, dbPath, root, opt)
+		defer d.Close()
+		err = d.CreateIndices()
+		if err == nil {
+			t.Errorf("Replaced an index whose log is in use")
+		}
+	})
+}
@@ -0,0 +1,116 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index"
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func TestSymlink(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "symlink_root")
+	os.MkdirAll(filepath.Join(root, "a/b"), 0750)
+	os.WriteFile(filepath.Join(root, "a/f"), make([]byte, 10), 0640)
+	os.Symlink("f", filepath.Join(root, "a/link"))
+	os.Symlink("missing", filepath.Join(root, "a/dangling"))
+	os.Symlink("..", filepath.Join(root, "a/b/loop"))
+	os.Symlink("a", filepath.Join(root, "alias"))
+
+	t.Run("nofollow", func(t *testing.T) {
+		d := indexTestDir(t, filepath.Join(dir, "symlink.db"), root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+		defer d.Close()
+		expected := map[string]struct {
+			fileType string
+			target   string
+			dangling bool
+		}{
+			"a/f":        {"f", "", false},
+			"a/link":     {"l", "f", false},
+			"a/dangling": {"l", "missing", true},
+			"a/b/loop":   {"l", "..", false},
+			"alias":      {"l", "a", false},
+		}
+		for path, x := range expected {
+			id, err := d.GetId(path)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			e, err := d.GetEntry(id)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			if e.Type != x.fileType || e.Target != x.target || e.Dangling != x.dangling {
+				t.Errorf("%s: got (%s, %s, %v), expected (%s, %s, %v)", path, e.Type, e.Target, e.Dangling,
+					x.fileType, x.target, x.dangling)
+			}
+		}
+		rootId, err := d.GetId("")
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		opt := db.NewFindOpt(rootId)
+		opt.Dangling = true
+		n := 0
+		d.Find(opt, func(id int64, name string) error {
+			n++
+			return nil
+		})
+		if n != 1 {
+			t.Errorf("Found %d dangling links, expected 1", n)
+		}
+	})
+
+	t.Run("follow", func(t *testing.T) {
+		d, err := db.NewIndexDb(filepath.Join(dir, "symlink_follow.db"), db.IndexDbOpt{Reset: true, BatchSize: 10000})
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		defer d.Close()
+		s := index.NewFileIndexer(d, 4)
+		s.ScanOpt.FollowSymlinks = true
+		err = s.IndexDir(root)
+		if err != nil {
+			t.Fatalf("Got error %s", err.Error())
+		}
+		for path, fileType := range map[string]string{"a/link": "f", "alias": "d", "alias/f": "f", "a/b/loop": "d"} {
+			id, err := d.GetId(path)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			e, err := d.GetEntry(id)
+			if err != nil {
+				t.Fatalf("Got error %s", err.Error())
+			}
+			if e.Type != fileType {
+				t.Errorf("%s: got type %s, expected %s", path, e.Type, fileType)
+			}
+		}
+		// a/b/loop and alias/b/loop point to one of their ancestors
+		if s.Stats().NErrors != 2 {
+			t.Errorf("Got %d errors, expected 2 loops", s.Stats().NErrors)
+		}
+		_, err = d.GetId("a/b/loop/a")
+		if err == nil {
+			t.Errorf("Loop was followed")
+		}
+	})
+}
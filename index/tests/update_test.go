@@ -0,0 +1,138 @@
+/*
+Copyright © 2022 Antonin Portelli <antonin.portelli@me.com>
+
+This program is free software: you can redistribute it and/or modify
+it under the terms of the GNU General Public License as published by
+the Free Software Foundation, either version 3 of the License, or
+(at your option) any later version.
+
+This program is distributed in the hope that it will be useful,
+but WITHOUT ANY WARRANTY; without even the implied warranty of
+MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+GNU General Public License for more details.
+
+You should have received a copy of the GNU General Public License
+along with this program. If not, see <http://www.gnu.org/licenses/>.
+*/
+package index
+
+import (
+	"database/sql"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aportelli/hyperspace/index"
+	"github.com/aportelli/hyperspace/index/db"
+)
+
+func indexTestDir(t *testing.T, dbPath string, root string, opt db.IndexDbOpt) *db.IndexDb {
+	d, err := db.NewIndexDb(dbPath, opt)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	s := index.NewFileIndexer(d, 4)
+	err = s.IndexDir(root)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	return d
+}
+
+// Index root into a new database with a legacy root, whose ids are those of an
+// index predating multiple roots
+func indexLegacyDir(t *testing.T, dbPath string, root string) *db.IndexDb {
+	d, err := db.NewIndexDb(dbPath, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	absRoot, _ := filepath.Abs(root)
+	err = d.SetRoot(absRoot, root)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	d.Close()
+	raw, err := sql.Open("sqlite3", dbPath)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	_, err = raw.Exec("UPDATE roots SET legacy = 1")
+	raw.Close()
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	return indexTestDir(t, dbPath, root, db.IndexDbOpt{Update: true, BatchSize: 10000})
+}
+
+func TestUpdate(t *testing.T) {
+	dir := t.TempDir()
+	root := filepath.Join(dir, "update_root")
+	dbPath := filepath.Join(dir, "update.db")
+	os.MkdirAll(filepath.Join(root, "a/b"), 0750)
+	os.WriteFile(filepath.Join(root, "a/f1"), []byte{1}, 0640)
+	os.WriteFile(filepath.Join(root, "a/b/f2"), []byte{1, 2}, 0640)
+	d := indexTestDir(t, dbPath, root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	d.Close()
+
+	os.WriteFile(filepath.Join(root, "a/f1"), []byte{1, 2, 3}, 0640)
+	os.RemoveAll(filepath.Join(root, "a/b"))
+	os.WriteFile(filepath.Join(root, "f3"), []byte{1}, 0640)
+	d = indexTestDir(t, dbPath, root, db.IndexDbOpt{Update: true, BatchSize: 10000})
+	defer d.Close()
+
+	if d.Insertions != 1 || d.Deletions != 2 {
+		t.Errorf("Got %d insertion(s) and %d deletion(s), expected 1 and 2", d.Insertions, d.Deletions)
+	}
+	for _, path := range []string{"a/b", "a/b/f2"} {
+		_, err := d.GetId(path)
+		if err == nil {
+			t.Errorf("Deleted path %s still in the index", path)
+		}
+	}
+	id, err := d.GetId("a/f1")
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	e, err := d.GetEntry(id)
+	if err != nil {
+		t.Fatalf("Got error %s", err.Error())
+	}
+	if e.Size != 3 {
+		t.Errorf("Got size %d, expected 3", e.Size)
+	}
+	if e.Mode&0777 != 0640 {
+		t.Errorf("Got mode %o, expected 640", e.Mode&0777)
+	}
+	_, err = d.GetId("f3")
+	if err != nil {
+		t.Errorf("Got error %s", err.Error())
+	}
+}
+
+func TestUpdateUnreadable(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("permissions are not enforced for root")
+	}
+	dir := t.TempDir()
+	root := filepath.Join(dir, "update_root")
+	dbPath := filepath.Join(dir, "update.db")
+	os.MkdirAll(filepath.Join(root, "locked/sub"), 0750)
+	os.WriteFile(filepath.Join(root, "locked/sub/f"), []byte{1}, 0640)
+	os.WriteFile(filepath.Join(root, "g"), []byte{1}, 0640)
+	d := indexTestDir(t, dbPath, root, db.IndexDbOpt{Reset: true, BatchSize: 10000})
+	d.Close()
+
+	os.Chmod(filepath.Join(root, "locked"), 0)
+	defer os.Chmod(filepath.Join(root, "locked"), 0750)
+	d = indexTestDir(t, dbPath, root, db.IndexDbOpt{Update: true, BatchSize: 10000})
+	defer d.Close()
+	if d.Deletions != 0 {
+		t.Errorf("Got %d deletion(s) updating an unreadable directory, expected none", d.Deletions)
+	}
+	for _, path := range []string{"locked", "locked/sub", "locked/sub/f"} {
+		_, err := d.GetId(path)
+		if err != nil {
+			t.Errorf("Got error %s for %s", err.Error(), path)
+		}
+	}
+}